@@ -0,0 +1,1086 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configDuration is a time.Duration that is written as a Go duration string,
+// such as "2.5s", in configuration files.
+type configDuration time.Duration
+
+func (d configDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"2.5s\"")
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(parsed)
+	return nil
+}
+
+type endpointConfig struct {
+	Query         string `json:"query"`
+	Proxy         string `json:"proxy"`
+	ProxyTemplate string `json:"proxy_template"`
+	Health        string `json:"health"`
+	Config        string `json:"config"`
+	Metrics       string `json:"metrics"`
+	ProxyConfig   string `json:"proxy_config"`
+	Discovery     string `json:"discovery"`
+}
+
+type dns64Config struct {
+	Enabled bool     `json:"enabled"`
+	Prefix  string   `json:"prefix"`
+	Exclude []string `json:"exclude"`
+}
+
+type recursiveConfig struct {
+	Enabled           bool           `json:"enabled"`
+	RootHints         []string       `json:"root_hints"`
+	AuthorityPort     string         `json:"authority_port"`
+	ResolutionTimeout configDuration `json:"resolution_timeout"`
+}
+
+type targetConfig struct {
+	InstanceName    string          `json:"instance_name"`
+	ExperimentID    string          `json:"experiment_id"`
+	SecretKeySeed   string          `json:"secret_key_seed"`
+	NameServers     []string        `json:"name_servers"`
+	ResolverTimeout configDuration  `json:"resolver_timeout"`
+	BlockedDomains  []string        `json:"blocked_domains"`
+	QueryRateLimit  int             `json:"query_rate_limit"`
+	StaleCacheSize  int             `json:"stale_cache_size"`
+	StaleMaxAge     configDuration  `json:"stale_max_age"`
+	DNS64           dns64Config     `json:"dns64"`
+	Recursive       recursiveConfig `json:"recursive"`
+	ClientCAFile    string          `json:"client_ca_file"`
+	AllowedProxies  []string        `json:"allowed_proxies"`
+}
+
+type rateLimitConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+type mixingConfig struct {
+	Mode      string         `json:"mode"`
+	MinDelay  configDuration `json:"min_delay"`
+	MaxDelay  configDuration `json:"max_delay"`
+	BatchSize int            `json:"batch_size"`
+}
+
+type coverTrafficConfig struct {
+	Rate       float64  `json:"rate"`
+	TargetPath string   `json:"target_path"`
+	Names      []string `json:"names"`
+}
+
+type tokenConfig struct {
+	IssuerName    string `json:"issuer_name"`
+	IssuerKeyFile string `json:"issuer_key_file"`
+	OriginInfo    string `json:"origin_info"`
+	StoreDir      string `json:"store_dir"`
+}
+
+type proxyTransportConfig struct {
+	ForceHTTP2           bool           `json:"force_http2"`
+	MaxConnsPerHost      int            `json:"max_conns_per_host"`
+	MaxConcurrentStreams int            `json:"max_concurrent_streams"`
+	IdleConnTimeout      configDuration `json:"idle_conn_timeout"`
+	KeepAlive            configDuration `json:"keepalive"`
+	PingInterval         configDuration `json:"ping_interval"`
+	PingTimeout          configDuration `json:"ping_timeout"`
+	SessionCacheSize     int            `json:"session_cache_size"`
+}
+
+type proxyResolverConfig struct {
+	NameServers []string            `json:"name_servers"`
+	StaticHosts map[string][]string `json:"static_hosts"`
+	Timeout     configDuration      `json:"timeout"`
+	MinTTL      configDuration      `json:"min_ttl"`
+	MaxTTL      configDuration      `json:"max_ttl"`
+}
+
+type proxyRetryConfig struct {
+	MaxAttempts int             `json:"max_attempts"`
+	Budget      rateLimitConfig `json:"budget"`
+	MinBackoff  configDuration  `json:"min_backoff"`
+	MaxBackoff  configDuration  `json:"max_backoff"`
+}
+
+type proxyConfig struct {
+	MaxIdleConnsPerHost   int                  `json:"max_idle_conns_per_host"`
+	AllowedTargets        []string             `json:"allowed_targets"`
+	AllowAnyTarget        bool                 `json:"allow_any_target"`
+	AllowPrivateTargets   bool                 `json:"allow_private_targets"`
+	RequireTargetConfigs  bool                 `json:"require_target_configs"`
+	ForwardedHeaders      []string             `json:"forwarded_headers"`
+	ClientRateLimit       rateLimitConfig      `json:"client_rate_limit"`
+	TargetRateLimit       rateLimitConfig      `json:"target_rate_limit"`
+	MaxRateLimitedClients int                  `json:"max_rate_limited_clients"`
+	ConnectTimeout        configDuration       `json:"connect_timeout"`
+	TLSHandshakeTimeout   configDuration       `json:"tls_handshake_timeout"`
+	RequestTimeout        configDuration       `json:"request_timeout"`
+	Mixing                mixingConfig         `json:"mixing"`
+	CoverTraffic          coverTrafficConfig   `json:"cover_traffic"`
+	NextHop               string               `json:"next_hop"`
+	Tokens                tokenConfig          `json:"tokens"`
+	ClientCertFile        string               `json:"client_cert_file"`
+	ClientKeyFile         string               `json:"client_key_file"`
+	TargetCAFile          string               `json:"target_ca_file"`
+	TargetPins            map[string][]string  `json:"target_pins"`
+	PinReportOnly         bool                 `json:"pin_report_only"`
+	Transport             proxyTransportConfig `json:"transport"`
+	Resolver              proxyResolverConfig  `json:"resolver"`
+	Retry                 proxyRetryConfig     `json:"retry"`
+}
+
+type telemetryConfig struct {
+	Type                   string   `json:"type"`
+	ElasticsearchAddresses []string `json:"elasticsearch_addresses"`
+	ElasticsearchIndex     string   `json:"elasticsearch_index"`
+	GCPProjectID           string   `json:"gcp_project_id"`
+	GCPLogName             string   `json:"gcp_log_name"`
+}
+
+// Roles the server can run in. A proxy and a target run by the same
+// operator can link clients to their queries, so running both is only
+// meant for testing.
+const (
+	roleProxy    = "proxy"
+	roleTarget   = "target"
+	roleCombined = "both"
+)
+
+// serverConfig holds every setting of the server. It is built from the
+// defaults, then a configuration file, then environment variables and
+// finally command line flags, each overriding the previous one.
+type serverConfig struct {
+	Role          string            `json:"role"`
+	AllowCombined bool              `json:"allow_combined"`
+	Port          string            `json:"port"`
+	AdminAddress  string            `json:"admin_address"`
+	Verbose       bool              `json:"verbose"`
+	ProxyURI      string            `json:"proxy_uri"`
+	TargetURI     string            `json:"target_uri"`
+	TLS           listenerTLSConfig `json:"tls"`
+	Timeouts      timeoutsConfig    `json:"timeouts"`
+	Endpoints     endpointConfig    `json:"endpoints"`
+	Target        targetConfig      `json:"target"`
+	Proxy         proxyConfig       `json:"proxy"`
+	Telemetry     telemetryConfig   `json:"telemetry"`
+}
+
+// listenerTLSConfig is the certificate the listener serves TLS with.
+type listenerTLSConfig struct {
+	CertFile       string         `json:"cert_file"`
+	KeyFile        string         `json:"key_file"`
+	ReloadInterval configDuration `json:"reload_interval"`
+}
+
+// timeoutsConfig bounds how long clients may hold connections to the
+// listeners, so that slow or idle clients cannot exhaust them.
+type timeoutsConfig struct {
+	ReadHeader configDuration `json:"read_header"`
+	Read       configDuration `json:"read"`
+	Idle       configDuration `json:"idle"`
+}
+
+func defaultServerConfig() serverConfig {
+	return serverConfig{
+		Port:      "8080",
+		ProxyURI:  "https://dnsproxy.example.net",
+		TargetURI: "https://dnstarget.example.net",
+		TLS: listenerTLSConfig{
+			ReloadInterval: configDuration(time.Minute),
+		},
+		Timeouts: timeoutsConfig{
+			ReadHeader: configDuration(defaultReadHeaderTimeout),
+			Read:       configDuration(defaultReadTimeout),
+			Idle:       configDuration(defaultIdleTimeout),
+		},
+		Endpoints: endpointConfig{
+			Query:         "/dns-query",
+			Proxy:         "/proxy",
+			ProxyTemplate: "/dns-proxy{?targethost,targetpath}",
+			Health:        "/health",
+			Config:        "/.well-known/odohconfigs",
+			Metrics:       "/metrics",
+			ProxyConfig:   "/proxy-config",
+			Discovery:     "/discovery",
+		},
+		Target: targetConfig{
+			InstanceName:    "server_target_localhost",
+			ExperimentID:    "EXP_LOCAL",
+			NameServers:     []string{"1.1.1.1:53", "8.8.8.8:53", "9.9.9.9:53"},
+			ResolverTimeout: configDuration(2500 * time.Millisecond),
+			StaleMaxAge:     configDuration(24 * time.Hour),
+			DNS64: dns64Config{
+				Prefix: defaultDNS64Prefix,
+			},
+			Recursive: recursiveConfig{
+				RootHints:         defaultRootHints,
+				AuthorityPort:     defaultAuthorityPort,
+				ResolutionTimeout: configDuration(10 * time.Second),
+			},
+		},
+		Proxy: proxyConfig{
+			MaxIdleConnsPerHost:   1024,
+			MaxRateLimitedClients: 100000,
+			ConnectTimeout:        configDuration(5 * time.Second),
+			TLSHandshakeTimeout:   configDuration(5 * time.Second),
+			RequestTimeout:        configDuration(10 * time.Second),
+			Mixing: mixingConfig{
+				MaxDelay:  configDuration(100 * time.Millisecond),
+				BatchSize: 8,
+			},
+			CoverTraffic: coverTrafficConfig{
+				TargetPath: defaultCoverTargetPath,
+			},
+			Transport: proxyTransportConfig{
+				ForceHTTP2:           true,
+				MaxConcurrentStreams: 100,
+				IdleConnTimeout:      configDuration(90 * time.Second),
+				KeepAlive:            configDuration(30 * time.Second),
+				PingInterval:         configDuration(30 * time.Second),
+				PingTimeout:          configDuration(15 * time.Second),
+				SessionCacheSize:     1024,
+			},
+			Resolver: proxyResolverConfig{
+				Timeout: configDuration(2 * time.Second),
+				MinTTL:  configDuration(30 * time.Second),
+				MaxTTL:  configDuration(time.Hour),
+			},
+			Retry: proxyRetryConfig{
+				MaxAttempts: 3,
+				Budget:      rateLimitConfig{Rate: 10, Burst: 20},
+				MinBackoff:  configDuration(10 * time.Millisecond),
+				MaxBackoff:  configDuration(100 * time.Millisecond),
+			},
+		},
+		Telemetry: telemetryConfig{
+			Type:                   "LOG",
+			ElasticsearchAddresses: []string{"http://localhost:9200"},
+			ElasticsearchIndex:     INDEX,
+			GCPProjectID:           "odoh-target",
+			GCPLogName:             "odohserver-gcp",
+		},
+	}
+}
+
+// configSetting is a single setting that can be overridden by an
+// environment variable and a command line flag of the same meaning.
+type configSetting struct {
+	flag        string
+	environment string
+	usage       string
+	apply       func(config *serverConfig, value string) error
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	items := strings.Split(value, ",")
+	for index := range items {
+		items[index] = strings.TrimSpace(items[index])
+	}
+	return items
+}
+
+func parseBool(value string) (bool, error) {
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("expected true or false, got %q", value)
+	}
+	return enabled, nil
+}
+
+func parseInt(value string) (int, error) {
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("expected an integer, got %q", value)
+	}
+	return number, nil
+}
+
+var configSettings = []configSetting{
+	{"role", "SERVER_ROLE", "role of the server: proxy, target or both", func(c *serverConfig, v string) error {
+		c.Role = v
+		return nil
+	}},
+	{"allow-combined", "ALLOW_COMBINED_ROLES", "allow running as both proxy and target, for testing only", func(c *serverConfig, v string) (err error) {
+		c.AllowCombined, err = parseBool(v)
+		return
+	}},
+	{"port", "PORT", "port to listen on", func(c *serverConfig, v string) error {
+		c.Port = v
+		return nil
+	}},
+	{"admin-address", "ADMIN_ADDRESS", "host:port serving operator-only statistics, such as metrics and per-target connection pools, empty to disable", func(c *serverConfig, v string) error {
+		c.AdminAddress = v
+		return nil
+	}},
+	{"verbose", "VERBOSE", "log queries and answers", func(c *serverConfig, v string) (err error) {
+		c.Verbose, err = parseBool(v)
+		return
+	}},
+	{"proxy-uri", "PROXY_URI", "public URI of the proxy", func(c *serverConfig, v string) error {
+		c.ProxyURI = v
+		return nil
+	}},
+	{"target-uri", "TARGET_URI", "public URI of the target", func(c *serverConfig, v string) error {
+		c.TargetURI = v
+		return nil
+	}},
+	{"tls-cert", "TLS_CERT_FILE", "PEM certificate chain to serve TLS with, empty to serve plain HTTP", func(c *serverConfig, v string) error {
+		c.TLS.CertFile = v
+		return nil
+	}},
+	{"tls-key", "TLS_KEY_FILE", "PEM private key of the TLS certificate", func(c *serverConfig, v string) error {
+		c.TLS.KeyFile = v
+		return nil
+	}},
+	{"tls-reload-interval", "TLS_RELOAD_INTERVAL", "interval between checks for a renewed TLS certificate, 0 to never reload", func(c *serverConfig, v string) error {
+		interval, err := time.ParseDuration(v)
+		c.TLS.ReloadInterval = configDuration(interval)
+		return err
+	}},
+	{"read-header-timeout", "READ_HEADER_TIMEOUT", "time allowed to clients to send request headers", func(c *serverConfig, v string) error {
+		timeout, err := time.ParseDuration(v)
+		c.Timeouts.ReadHeader = configDuration(timeout)
+		return err
+	}},
+	{"read-timeout", "READ_TIMEOUT", "time allowed to clients to send a whole request", func(c *serverConfig, v string) error {
+		timeout, err := time.ParseDuration(v)
+		c.Timeouts.Read = configDuration(timeout)
+		return err
+	}},
+	{"idle-timeout", "IDLE_TIMEOUT", "time a kept-alive client connection may stay idle", func(c *serverConfig, v string) error {
+		timeout, err := time.ParseDuration(v)
+		c.Timeouts.Idle = configDuration(timeout)
+		return err
+	}},
+	{"instance-name", "TARGET_INSTANCE_NAME", "name of this target in telemetry", func(c *serverConfig, v string) error {
+		c.Target.InstanceName = v
+		return nil
+	}},
+	{"experiment-id", "EXPERIMENT_ID", "experiment identifier in telemetry", func(c *serverConfig, v string) error {
+		c.Target.ExperimentID = v
+		return nil
+	}},
+	{"secret-key-seed", "SEED_SECRET_KEY", "hex encoded seed for the target key pair", func(c *serverConfig, v string) error {
+		c.Target.SecretKeySeed = v
+		return nil
+	}},
+	{"name-servers", "NAME_SERVERS", "comma separated upstream name servers", func(c *serverConfig, v string) error {
+		c.Target.NameServers = splitList(v)
+		return nil
+	}},
+	{"resolver-timeout", "RESOLVER_TIMEOUT", "timeout for upstream queries", func(c *serverConfig, v string) error {
+		timeout, err := time.ParseDuration(v)
+		c.Target.ResolverTimeout = configDuration(timeout)
+		return err
+	}},
+	{"blocked-domains", "BLOCKED_DOMAINS", "comma separated domains to refuse", func(c *serverConfig, v string) error {
+		c.Target.BlockedDomains = splitList(v)
+		return nil
+	}},
+	{"query-rate-limit", "QUERY_RATE_LIMIT", "queries per second answered by the target, 0 for no limit", func(c *serverConfig, v string) (err error) {
+		c.Target.QueryRateLimit, err = parseInt(v)
+		return
+	}},
+	{"stale-cache-size", "STALE_CACHE_SIZE", "answers kept to serve stale, 0 to disable", func(c *serverConfig, v string) (err error) {
+		c.Target.StaleCacheSize, err = parseInt(v)
+		return
+	}},
+	{"dns64", "DNS64", "synthesize AAAA records from A records", func(c *serverConfig, v string) (err error) {
+		c.Target.DNS64.Enabled, err = parseBool(v)
+		return
+	}},
+	{"dns64-prefix", "DNS64_PREFIX", "prefix for synthesized AAAA records", func(c *serverConfig, v string) error {
+		c.Target.DNS64.Prefix = v
+		return nil
+	}},
+	{"dns64-exclude", "DNS64_EXCLUDE", "comma separated prefixes excluded from DNS64", func(c *serverConfig, v string) error {
+		c.Target.DNS64.Exclude = splitList(v)
+		return nil
+	}},
+	{"recursive", "RECURSIVE_RESOLUTION", "resolve recursively from the root instead of forwarding", func(c *serverConfig, v string) (err error) {
+		c.Target.Recursive.Enabled, err = parseBool(v)
+		return
+	}},
+	{"root-hints", "ROOT_HINTS", "comma separated root server addresses", func(c *serverConfig, v string) error {
+		c.Target.Recursive.RootHints = splitList(v)
+		return nil
+	}},
+	{"recursive-timeout", "RECURSIVE_RESOLUTION_TIMEOUT", "total time spent resolving a query recursively", func(c *serverConfig, v string) error {
+		timeout, err := time.ParseDuration(v)
+		c.Target.Recursive.ResolutionTimeout = configDuration(timeout)
+		return err
+	}},
+	{"client-ca", "TARGET_CLIENT_CA_FILE", "PEM CA certificates proxies must present a client certificate from, empty to accept any client", func(c *serverConfig, v string) error {
+		c.Target.ClientCAFile = v
+		return nil
+	}},
+	{"allowed-proxies", "TARGET_ALLOWED_PROXIES", "comma separated DNS or URI names of proxy client certificates accepted by the target", func(c *serverConfig, v string) error {
+		c.Target.AllowedProxies = splitList(v)
+		return nil
+	}},
+	{"allowed-targets", "ALLOWED_TARGETS", "comma separated target hosts the proxy forwards to, .domain for suffixes", func(c *serverConfig, v string) error {
+		c.Proxy.AllowedTargets = splitList(v)
+		return nil
+	}},
+	{"allow-any-target", "ALLOW_ANY_TARGET", "forward to any public target when no allowlist is set, making the proxy an open relay", func(c *serverConfig, v string) (err error) {
+		c.Proxy.AllowAnyTarget, err = parseBool(v)
+		return
+	}},
+	{"allow-private-targets", "ALLOW_PRIVATE_TARGETS", "allow targets with private or loopback addresses", func(c *serverConfig, v string) (err error) {
+		c.Proxy.AllowPrivateTargets, err = parseBool(v)
+		return
+	}},
+	{"require-target-configs", "REQUIRE_TARGET_CONFIGS", "only forward to targets publishing a valid ODoH configuration", func(c *serverConfig, v string) (err error) {
+		c.Proxy.RequireTargetConfigs, err = parseBool(v)
+		return
+	}},
+	{"forwarded-headers", "FORWARDED_HEADERS", "comma separated client headers forwarded to targets", func(c *serverConfig, v string) error {
+		c.Proxy.ForwardedHeaders = splitList(v)
+		return nil
+	}},
+	{"client-rate-limit", "CLIENT_RATE_LIMIT", "requests per second accepted from each client, 0 for no limit", func(c *serverConfig, v string) (err error) {
+		c.Proxy.ClientRateLimit.Rate, err = strconv.ParseFloat(v, 64)
+		return
+	}},
+	{"client-rate-burst", "CLIENT_RATE_BURST", "requests a client may send in a burst", func(c *serverConfig, v string) (err error) {
+		c.Proxy.ClientRateLimit.Burst, err = parseInt(v)
+		return
+	}},
+	{"target-rate-limit", "TARGET_RATE_LIMIT", "requests per second forwarded to each target, 0 for no limit", func(c *serverConfig, v string) (err error) {
+		c.Proxy.TargetRateLimit.Rate, err = strconv.ParseFloat(v, 64)
+		return
+	}},
+	{"target-rate-burst", "TARGET_RATE_BURST", "requests forwarded to a target in a burst", func(c *serverConfig, v string) (err error) {
+		c.Proxy.TargetRateLimit.Burst, err = parseInt(v)
+		return
+	}},
+	{"proxy-connect-timeout", "PROXY_CONNECT_TIMEOUT", "timeout for connecting to targets", func(c *serverConfig, v string) error {
+		timeout, err := time.ParseDuration(v)
+		c.Proxy.ConnectTimeout = configDuration(timeout)
+		return err
+	}},
+	{"proxy-tls-timeout", "PROXY_TLS_TIMEOUT", "timeout for TLS handshakes with targets", func(c *serverConfig, v string) error {
+		timeout, err := time.ParseDuration(v)
+		c.Proxy.TLSHandshakeTimeout = configDuration(timeout)
+		return err
+	}},
+	{"proxy-request-timeout", "PROXY_REQUEST_TIMEOUT", "total time allowed for a proxied request", func(c *serverConfig, v string) error {
+		timeout, err := time.ParseDuration(v)
+		c.Proxy.RequestTimeout = configDuration(timeout)
+		return err
+	}},
+	{"mixing", "PROXY_MIXING", "timing decorrelation mode: delay or batch, empty to disable", func(c *serverConfig, v string) error {
+		c.Proxy.Mixing.Mode = v
+		return nil
+	}},
+	{"mixing-max-delay", "PROXY_MIXING_MAX_DELAY", "longest time a request is held for mixing", func(c *serverConfig, v string) error {
+		delay, err := time.ParseDuration(v)
+		c.Proxy.Mixing.MaxDelay = configDuration(delay)
+		return err
+	}},
+	{"next-hop", "PROXY_NEXT_HOP", "URI template of a proxy to forward to instead of targets, such as https://proxy.example.net/proxy{?targethost,targetpath}", func(c *serverConfig, v string) error {
+		c.Proxy.NextHop = v
+		return nil
+	}},
+	{"token-issuer-name", "PROXY_TOKEN_ISSUER_NAME", "name of the issuer of PrivateTokens clients must present", func(c *serverConfig, v string) error {
+		c.Proxy.Tokens.IssuerName = v
+		return nil
+	}},
+	{"token-store-dir", "PROXY_TOKEN_STORE_DIR", "directory persisting redeemed tokens across restarts and replicas, empty to keep them in memory", func(c *serverConfig, v string) error {
+		c.Proxy.Tokens.StoreDir = v
+		return nil
+	}},
+	{"token-issuer-key", "PROXY_TOKEN_ISSUER_KEY_FILE", "PEM file with the token issuer public key, empty to accept clients without tokens", func(c *serverConfig, v string) error {
+		c.Proxy.Tokens.IssuerKeyFile = v
+		return nil
+	}},
+	{"proxy-client-cert", "PROXY_CLIENT_CERT_FILE", "PEM client certificate the proxy presents to targets", func(c *serverConfig, v string) error {
+		c.Proxy.ClientCertFile = v
+		return nil
+	}},
+	{"proxy-client-key", "PROXY_CLIENT_KEY_FILE", "PEM private key of the proxy client certificate", func(c *serverConfig, v string) error {
+		c.Proxy.ClientKeyFile = v
+		return nil
+	}},
+	{"target-ca", "PROXY_TARGET_CA_FILE", "PEM CA certificates trusted for targets instead of the system roots", func(c *serverConfig, v string) error {
+		c.Proxy.TargetCAFile = v
+		return nil
+	}},
+	{"target-pins", "PROXY_TARGET_PINS", "comma separated host=sha256/<base64> SPKI pins of targets", func(c *serverConfig, v string) error {
+		pins := make(map[string][]string)
+		for _, entry := range splitList(v) {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return fmt.Errorf("pin %q is not of the form host=sha256/<base64>", entry)
+			}
+			pins[parts[0]] = append(pins[parts[0]], parts[1])
+		}
+		c.Proxy.TargetPins = pins
+		return nil
+	}},
+	{"pin-report-only", "PROXY_PIN_REPORT_ONLY", "only log and count target pin failures instead of refusing the connection", func(c *serverConfig, v string) (err error) {
+		c.Proxy.PinReportOnly, err = parseBool(v)
+		return
+	}},
+	{"force-http2", "PROXY_FORCE_HTTP2", "only talk to targets over HTTP/2, false for HTTP/1.1", func(c *serverConfig, v string) (err error) {
+		c.Proxy.Transport.ForceHTTP2, err = parseBool(v)
+		return
+	}},
+	{"max-conns-per-target", "PROXY_MAX_CONNS_PER_TARGET", "most connections the proxy opens to a single target, 0 for no limit", func(c *serverConfig, v string) (err error) {
+		c.Proxy.Transport.MaxConnsPerHost, err = parseInt(v)
+		return
+	}},
+	{"max-concurrent-streams", "PROXY_MAX_CONCURRENT_STREAMS", "most concurrent requests on one HTTP/2 connection to a target", func(c *serverConfig, v string) (err error) {
+		c.Proxy.Transport.MaxConcurrentStreams, err = parseInt(v)
+		return
+	}},
+	{"proxy-idle-timeout", "PROXY_IDLE_CONN_TIMEOUT", "time after which unused connections to targets are closed", func(c *serverConfig, v string) error {
+		timeout, err := time.ParseDuration(v)
+		c.Proxy.Transport.IdleConnTimeout = configDuration(timeout)
+		return err
+	}},
+	{"proxy-ping-interval", "PROXY_PING_INTERVAL", "silence after which HTTP/2 connections to targets are checked with a ping, 0 to disable", func(c *serverConfig, v string) error {
+		interval, err := time.ParseDuration(v)
+		c.Proxy.Transport.PingInterval = configDuration(interval)
+		return err
+	}},
+	{"proxy-name-servers", "PROXY_NAME_SERVERS", "comma separated name servers resolving target hosts, empty for the system resolver", func(c *serverConfig, v string) error {
+		c.Proxy.Resolver.NameServers = splitList(v)
+		return nil
+	}},
+	{"proxy-static-hosts", "PROXY_STATIC_HOSTS", "comma separated host=address entries resolving target hosts without DNS", func(c *serverConfig, v string) error {
+		hosts := make(map[string][]string)
+		for _, entry := range splitList(v) {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return fmt.Errorf("static host %q is not of the form host=address", entry)
+			}
+			hosts[parts[0]] = append(hosts[parts[0]], parts[1])
+		}
+		c.Proxy.Resolver.StaticHosts = hosts
+		return nil
+	}},
+	{"proxy-retry-attempts", "PROXY_RETRY_ATTEMPTS", "addresses of a target tried before giving up on a connection", func(c *serverConfig, v string) (err error) {
+		c.Proxy.Retry.MaxAttempts, err = parseInt(v)
+		return
+	}},
+	{"proxy-retry-rate", "PROXY_RETRY_RATE", "connection retries per second across all targets", func(c *serverConfig, v string) (err error) {
+		c.Proxy.Retry.Budget.Rate, err = strconv.ParseFloat(v, 64)
+		return
+	}},
+	{"proxy-retry-burst", "PROXY_RETRY_BURST", "connection retries allowed in a burst across all targets", func(c *serverConfig, v string) (err error) {
+		c.Proxy.Retry.Budget.Burst, err = parseInt(v)
+		return
+	}},
+	{"cover-traffic-rate", "PROXY_COVER_TRAFFIC_RATE", "dummy queries per second sent to each allowlisted target, 0 to disable", func(c *serverConfig, v string) (err error) {
+		c.Proxy.CoverTraffic.Rate, err = strconv.ParseFloat(v, 64)
+		return
+	}},
+	{"telemetry", "TELEMETRY_TYPE", "telemetry backend: LOG, ELK or GCP", func(c *serverConfig, v string) error {
+		c.Telemetry.Type = v
+		return nil
+	}},
+	{"elasticsearch-addresses", "ELASTICSEARCH_ADDRESSES", "comma separated Elasticsearch addresses", func(c *serverConfig, v string) error {
+		c.Telemetry.ElasticsearchAddresses = splitList(v)
+		return nil
+	}},
+	{"gcp-project", "GCP_PROJECT_ID", "Google Cloud project for telemetry", func(c *serverConfig, v string) error {
+		c.Telemetry.GCPProjectID = v
+		return nil
+	}},
+}
+
+// loadConfigFile overrides config with the settings present in the file at
+// path, which is YAML if its name ends in .yaml or .yml and JSON otherwise.
+// Unknown settings are rejected.
+func loadConfigFile(config *serverConfig, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if extension := strings.ToLower(filepath.Ext(path)); extension == ".yaml" || extension == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// yamlToJSON converts a YAML document to JSON, so that YAML files are decoded
+// with the same setting names, types and checks as JSON files.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	document, err := jsonValue(document)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(document)
+}
+
+// jsonValue replaces the maps in a decoded YAML value, which may have keys
+// of any type, by JSON objects.
+func jsonValue(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("setting name %v is not a string", key)
+			}
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = converted
+		}
+		return object, nil
+	case []interface{}:
+		array := make([]interface{}, len(value))
+		for index, item := range value {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			array[index] = converted
+		}
+		return array, nil
+	default:
+		return value, nil
+	}
+}
+
+// loadConfig builds the effective configuration from args, which must not
+// include the program name. It reports whether --print-config was given.
+func loadConfig(args []string) (serverConfig, bool, error) {
+	config := defaultServerConfig()
+
+	flags := flag.NewFlagSet("odoh-server", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a JSON or YAML configuration file")
+	printConfig := flags.Bool("print-config", false, "print the effective configuration and exit")
+	flagValues := make([]*string, len(configSettings))
+	for index, setting := range configSettings {
+		flagValues[index] = flags.String(setting.flag, "", fmt.Sprintf("%s (environment: %s)", setting.usage, setting.environment))
+	}
+	if err := flags.Parse(args); err != nil {
+		return config, false, err
+	}
+	if flags.NArg() > 0 {
+		return config, false, fmt.Errorf("unexpected arguments: %v", flags.Args())
+	}
+
+	if *configPath != "" {
+		if err := loadConfigFile(&config, *configPath); err != nil {
+			return config, false, err
+		}
+	}
+
+	for _, setting := range configSettings {
+		if value, ok := os.LookupEnv(setting.environment); ok && value != "" {
+			if err := setting.apply(&config, value); err != nil {
+				return config, false, fmt.Errorf("environment variable %s: %v", setting.environment, err)
+			}
+		}
+	}
+
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		for index, setting := range configSettings {
+			if f.Name == setting.flag && flagErr == nil {
+				if err := setting.apply(&config, *flagValues[index]); err != nil {
+					flagErr = fmt.Errorf("flag --%s: %v", setting.flag, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return config, false, flagErr
+	}
+
+	return config, *printConfig, config.validate()
+}
+
+func validateHostPort(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return errors.New("missing host")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+func validatePort(port string) error {
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || number == 0 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// validate checks every setting and reports all problems at once.
+func (c serverConfig) validate() error {
+	var problems []string
+	report := func(setting string, format string, args ...interface{}) {
+		problems = append(problems, setting+": "+fmt.Sprintf(format, args...))
+	}
+
+	switch c.Role {
+	case roleProxy, roleTarget:
+	case roleCombined:
+		if !c.AllowCombined {
+			report("role", "running both proxy and target lets one operator link clients to their queries; set allow_combined to do so for testing")
+		}
+	default:
+		report("role", "must be %s, %s or %s, got %q", roleProxy, roleTarget, roleCombined, c.Role)
+	}
+
+	if err := validatePort(c.Port); err != nil {
+		report("port", "%v", err)
+	}
+	if c.AdminAddress != "" {
+		if err := validateHostPort(c.AdminAddress); err != nil {
+			report("admin_address", "%q is not a host:port address: %v", c.AdminAddress, err)
+		}
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		report("tls", "cert_file and key_file must be set together")
+	}
+	if c.TLS.ReloadInterval < 0 {
+		report("tls.reload_interval", "must not be negative")
+	}
+	for setting, timeout := range map[string]configDuration{"timeouts.read_header": c.Timeouts.ReadHeader, "timeouts.read": c.Timeouts.Read, "timeouts.idle": c.Timeouts.Idle} {
+		if timeout <= 0 {
+			report(setting, "must be positive")
+		}
+	}
+	if c.Target.ClientCAFile != "" && c.TLS.CertFile == "" {
+		report("target.client_ca_file", "requires tls.cert_file, client certificates need a TLS listener")
+	}
+	if len(c.Target.AllowedProxies) > 0 && c.Target.ClientCAFile == "" {
+		report("target.allowed_proxies", "requires target.client_ca_file")
+	}
+	if (c.Proxy.ClientCertFile == "") != (c.Proxy.ClientKeyFile == "") {
+		report("proxy", "client_cert_file and client_key_file must be set together")
+	}
+	endpoints := map[string]string{
+		"endpoints.query":        c.Endpoints.Query,
+		"endpoints.proxy":        c.Endpoints.Proxy,
+		"endpoints.health":       c.Endpoints.Health,
+		"endpoints.config":       c.Endpoints.Config,
+		"endpoints.metrics":      c.Endpoints.Metrics,
+		"endpoints.proxy_config": c.Endpoints.ProxyConfig,
+		"endpoints.discovery":    c.Endpoints.Discovery,
+	}
+	seenPaths := make(map[string]string)
+	for _, setting := range []string{"endpoints.query", "endpoints.proxy", "endpoints.health", "endpoints.config", "endpoints.metrics", "endpoints.proxy_config", "endpoints.discovery"} {
+		path := endpoints[setting]
+		if !strings.HasPrefix(path, "/") || path == "/" {
+			report(setting, "must be an absolute path other than /, got %q", path)
+		} else if other, ok := seenPaths[path]; ok {
+			report(setting, "path %q is already used by %s", path, other)
+		}
+		seenPaths[path] = setting
+	}
+	if template, err := newProxyURITemplate(c.Endpoints.ProxyTemplate); err != nil {
+		report("endpoints.proxy_template", "%v", err)
+	} else {
+		for path, other := range seenPaths {
+			if template.path.MatchString(path) {
+				report("endpoints.proxy_template", "matches path %q of %s", path, other)
+			}
+		}
+	}
+
+	if c.Target.SecretKeySeed != "" {
+		if _, err := hex.DecodeString(c.Target.SecretKeySeed); err != nil {
+			report("target.secret_key_seed", "must be hex encoded")
+		}
+	}
+	if len(c.Target.NameServers) == 0 && !c.Target.Recursive.Enabled {
+		report("target.name_servers", "at least one name server is required unless recursive resolution is enabled")
+	}
+	for index, nameServer := range c.Target.NameServers {
+		if err := validateHostPort(nameServer); err != nil {
+			report(fmt.Sprintf("target.name_servers[%d]", index), "%q is not a host:port address: %v", nameServer, err)
+		}
+	}
+	if c.Target.ResolverTimeout <= 0 {
+		report("target.resolver_timeout", "must be positive")
+	}
+	if c.Target.QueryRateLimit < 0 {
+		report("target.query_rate_limit", "must not be negative")
+	}
+	if c.Target.StaleCacheSize < 0 {
+		report("target.stale_cache_size", "must not be negative")
+	}
+	if c.Target.StaleMaxAge < 0 {
+		report("target.stale_max_age", "must not be negative")
+	}
+	if c.Target.DNS64.Enabled {
+		if _, err := newDNS64Synthesizer(c.Target.DNS64.Prefix, c.Target.DNS64.Exclude); err != nil {
+			report("target.dns64", "%v", err)
+		}
+	}
+	if c.Target.Recursive.Enabled {
+		if len(c.Target.Recursive.RootHints) == 0 {
+			report("target.recursive.root_hints", "at least one root server address is required")
+		}
+		for index, hint := range c.Target.Recursive.RootHints {
+			if net.ParseIP(hint) == nil {
+				report(fmt.Sprintf("target.recursive.root_hints[%d]", index), "%q is not an IP address", hint)
+			}
+		}
+		if err := validatePort(c.Target.Recursive.AuthorityPort); err != nil {
+			report("target.recursive.authority_port", "%v", err)
+		}
+		if c.Target.Recursive.ResolutionTimeout <= 0 {
+			report("target.recursive.resolution_timeout", "must be positive")
+		}
+	}
+
+	if c.Proxy.MaxIdleConnsPerHost < 0 {
+		report("proxy.max_idle_conns_per_host", "must not be negative")
+	}
+	if _, err := newHeaderPolicy(c.Proxy.ForwardedHeaders); err != nil {
+		report("proxy.forwarded_headers", "%v", err)
+	}
+	for setting, limit := range map[string]rateLimitConfig{"proxy.client_rate_limit": c.Proxy.ClientRateLimit, "proxy.target_rate_limit": c.Proxy.TargetRateLimit} {
+		if limit.Rate < 0 {
+			report(setting+".rate", "must not be negative")
+		} else if limit.Rate > 0 && limit.Burst < 1 {
+			report(setting+".burst", "must be at least 1 when a rate is set")
+		}
+	}
+	if c.Proxy.ClientRateLimit.Rate > 0 && c.Proxy.MaxRateLimitedClients < 1 {
+		report("proxy.max_rate_limited_clients", "must be at least 1 when client rate limiting is enabled")
+	}
+	if c.Proxy.ConnectTimeout <= 0 {
+		report("proxy.connect_timeout", "must be positive")
+	}
+	if c.Proxy.TLSHandshakeTimeout <= 0 {
+		report("proxy.tls_handshake_timeout", "must be positive")
+	}
+	if c.Proxy.RequestTimeout <= 0 {
+		report("proxy.request_timeout", "must be positive")
+	}
+	switch c.Proxy.Mixing.Mode {
+	case "":
+	case mixingModeDelay, mixingModeBatch:
+		if c.Proxy.Mixing.MinDelay < 0 {
+			report("proxy.mixing.min_delay", "must not be negative")
+		}
+		if c.Proxy.Mixing.MaxDelay <= 0 || c.Proxy.Mixing.MaxDelay < c.Proxy.Mixing.MinDelay {
+			report("proxy.mixing.max_delay", "must be positive and at least proxy.mixing.min_delay")
+		}
+		if c.Proxy.Mixing.MaxDelay >= c.Proxy.RequestTimeout {
+			report("proxy.mixing.max_delay", "must leave time for the request within proxy.request_timeout")
+		}
+		if c.Proxy.Mixing.Mode == mixingModeBatch && c.Proxy.Mixing.BatchSize < 2 {
+			report("proxy.mixing.batch_size", "must be at least 2")
+		}
+	default:
+		report("proxy.mixing.mode", "must be %s, %s or empty, got %q", mixingModeDelay, mixingModeBatch, c.Proxy.Mixing.Mode)
+	}
+	if c.Proxy.Transport.MaxConnsPerHost < 0 {
+		report("proxy.transport.max_conns_per_host", "must not be negative")
+	}
+	if c.Proxy.Transport.MaxConcurrentStreams < 1 {
+		report("proxy.transport.max_concurrent_streams", "must be at least 1")
+	}
+	if c.Proxy.Transport.IdleConnTimeout <= 0 {
+		report("proxy.transport.idle_conn_timeout", "must be positive")
+	}
+	if c.Proxy.Transport.KeepAlive < 0 || c.Proxy.Transport.PingInterval < 0 || c.Proxy.Transport.PingTimeout < 0 {
+		report("proxy.transport", "keepalive, ping_interval and ping_timeout must not be negative")
+	}
+	if c.Proxy.Transport.SessionCacheSize < 0 {
+		report("proxy.transport.session_cache_size", "must not be negative")
+	}
+	for index, nameServer := range c.Proxy.Resolver.NameServers {
+		if _, _, err := net.SplitHostPort(nameServer); err != nil {
+			report(fmt.Sprintf("proxy.resolver.name_servers[%d]", index), "%q is not a host:port address", nameServer)
+		}
+	}
+	for host, addresses := range c.Proxy.Resolver.StaticHosts {
+		for _, address := range addresses {
+			if net.ParseIP(address) == nil {
+				report("proxy.resolver.static_hosts."+host, "%q is not an IP address", address)
+			}
+		}
+	}
+	if c.Proxy.Resolver.Timeout <= 0 {
+		report("proxy.resolver.timeout", "must be positive")
+	}
+	if c.Proxy.Resolver.MinTTL < 0 || c.Proxy.Resolver.MaxTTL < c.Proxy.Resolver.MinTTL {
+		report("proxy.resolver", "min_ttl must not be negative nor above max_ttl")
+	}
+	if c.Proxy.Retry.MaxAttempts < 1 {
+		report("proxy.retry.max_attempts", "must be at least 1")
+	}
+	if c.Proxy.Retry.Budget.Rate < 0 {
+		report("proxy.retry.budget.rate", "must not be negative")
+	} else if c.Proxy.Retry.Budget.Rate > 0 && c.Proxy.Retry.Budget.Burst < 1 {
+		report("proxy.retry.budget.burst", "must be at least 1 when a rate is set")
+	}
+	if c.Proxy.Retry.MinBackoff < 0 || c.Proxy.Retry.MaxBackoff < c.Proxy.Retry.MinBackoff {
+		report("proxy.retry", "min_backoff must not be negative nor above max_backoff")
+	}
+	for host, pins := range c.Proxy.TargetPins {
+		if len(pins) == 0 {
+			report("proxy.target_pins."+host, "must list at least one pin")
+		}
+		for _, pin := range pins {
+			if _, err := parseSPKIPin(pin); err != nil {
+				report("proxy.target_pins."+host, "%v", err)
+			}
+		}
+	}
+	if c.Proxy.NextHop != "" {
+		if _, err := newNextHopProxy(c.Proxy.NextHop); err != nil {
+			report("proxy.next_hop", "%v", err)
+		}
+	}
+	if c.Proxy.Tokens.IssuerKeyFile != "" {
+		if c.Proxy.Tokens.IssuerName == "" {
+			report("proxy.tokens.issuer_name", "must be set when proxy.tokens.issuer_key_file is")
+		}
+		if _, err := loadTokenKey(c.Proxy.Tokens.IssuerKeyFile); err != nil {
+			report("proxy.tokens.issuer_key_file", "%v", err)
+		}
+	}
+	if c.Proxy.CoverTraffic.Rate < 0 {
+		report("proxy.cover_traffic.rate", "must not be negative")
+	}
+	if c.Proxy.CoverTraffic.Rate > 0 {
+		if err := validateTargetPath(c.Proxy.CoverTraffic.TargetPath); err != nil {
+			report("proxy.cover_traffic.target_path", "%v", err)
+		}
+		for index, name := range c.Proxy.CoverTraffic.Names {
+			if _, ok := dns.IsDomainName(name); !ok || name == "" {
+				report(fmt.Sprintf("proxy.cover_traffic.names[%d]", index), "%q is not a domain name", name)
+			}
+		}
+	}
+	for index, entry := range c.Proxy.AllowedTargets {
+		if name := strings.TrimPrefix(entry, "."); name == "" || strings.ContainsAny(name, "/?#@ ") {
+			report(fmt.Sprintf("proxy.allowed_targets[%d]", index), "%q is not a host name or .domain suffix", entry)
+		}
+	}
+	if len(c.Proxy.AllowedTargets) > 0 && c.Proxy.AllowAnyTarget {
+		report("proxy.allow_any_target", "must not be set together with proxy.allowed_targets")
+	} else if c.runsProxy() && len(c.Proxy.AllowedTargets) == 0 && !c.Proxy.AllowAnyTarget {
+		report("proxy.allowed_targets", "required unless proxy.allow_any_target is set, a proxy forwarding to any target is an open relay")
+	}
+
+	switch c.Telemetry.Type {
+	case "LOG":
+	case "ELK":
+		if len(c.Telemetry.ElasticsearchAddresses) == 0 {
+			report("telemetry.elasticsearch_addresses", "required when telemetry.type is ELK")
+		}
+		if c.Telemetry.ElasticsearchIndex == "" {
+			report("telemetry.elasticsearch_index", "required when telemetry.type is ELK")
+		}
+	case "GCP":
+		if c.Telemetry.GCPProjectID == "" {
+			report("telemetry.gcp_project_id", "required when telemetry.type is GCP")
+		}
+		if c.Telemetry.GCPLogName == "" {
+			report("telemetry.gcp_log_name", "required when telemetry.type is GCP")
+		}
+	default:
+		report("telemetry.type", "must be one of LOG, ELK or GCP, got %q", c.Telemetry.Type)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// print writes the effective configuration as JSON, with secrets
+// redacted.
+func (c serverConfig) print() error {
+	if c.Target.SecretKeySeed != "" {
+		c.Target.SecretKeySeed = "<redacted>"
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(c)
+}
+
+func (c serverConfig) runsProxy() bool {
+	return c.Role == roleProxy || c.Role == roleCombined
+}
+
+func (c serverConfig) runsTarget() bool {
+	return c.Role == roleTarget || c.Role == roleCombined
+}
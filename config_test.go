@@ -0,0 +1,246 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes contents to a file called name in a new directory
+// and returns its path, with a function removing the directory.
+func writeConfigFile(t *testing.T, name string, contents string) (string, func()) {
+	directory, err := ioutil.TempDir("", "odoh-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(directory, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		os.RemoveAll(directory)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(directory) }
+}
+
+// setEnvironment sets the environment variables in values and returns a
+// function restoring their previous state.
+func setEnvironment(values map[string]string) func() {
+	previous := make(map[string]*string)
+	for name, value := range values {
+		if old, ok := os.LookupEnv(name); ok {
+			previous[name] = &old
+		} else {
+			previous[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, old := range previous {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		contents string
+	}{
+		{
+			name: "config.json",
+			contents: `{
+	"role": "proxy",
+	"port": "8443",
+	"proxy": {
+		"allowed_targets": ["odoh.example.net", ".example.org"],
+		"request_timeout": "3s",
+		"resolver": {"static_hosts": {"odoh.example.net": ["192.0.2.1"]}},
+		"retry": {"max_attempts": 2, "budget": {"rate": 5, "burst": 7}}
+	}
+}`,
+		},
+		{
+			name: "config.yaml",
+			contents: `role: proxy
+port: "8443"
+proxy:
+  allowed_targets:
+    - odoh.example.net
+    - .example.org
+  request_timeout: 3s
+  resolver:
+    static_hosts:
+      odoh.example.net: [192.0.2.1]
+  retry:
+    max_attempts: 2
+    budget:
+      rate: 5
+      burst: 7
+`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path, cleanup := writeConfigFile(t, test.name, test.contents)
+			defer cleanup()
+
+			config, printConfig, err := loadConfig([]string{"--config", path, "--print-config"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !printConfig {
+				t.Error("--print-config not reported")
+			}
+			if config.Role != roleProxy || config.Port != "8443" {
+				t.Errorf("role %q and port %q, want %q and 8443", config.Role, config.Port, roleProxy)
+			}
+			if want := []string{"odoh.example.net", ".example.org"}; !reflect.DeepEqual(config.Proxy.AllowedTargets, want) {
+				t.Errorf("allowed targets %v, want %v", config.Proxy.AllowedTargets, want)
+			}
+			if time.Duration(config.Proxy.RequestTimeout) != 3*time.Second {
+				t.Errorf("request timeout %v, want 3s", time.Duration(config.Proxy.RequestTimeout))
+			}
+			if want := map[string][]string{"odoh.example.net": {"192.0.2.1"}}; !reflect.DeepEqual(config.Proxy.Resolver.StaticHosts, want) {
+				t.Errorf("static hosts %v, want %v", config.Proxy.Resolver.StaticHosts, want)
+			}
+			if retry := config.Proxy.Retry; retry.MaxAttempts != 2 || retry.Budget.Rate != 5 || retry.Budget.Burst != 7 {
+				t.Errorf("retry %+v, want 2 attempts at 5 per second with a burst of 7", retry)
+			}
+			// Settings absent from the file keep their defaults
+			if config.Endpoints.Query != defaultServerConfig().Endpoints.Query {
+				t.Errorf("query endpoint %q, want the default", config.Endpoints.Query)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileRejectsUnknownSettings(t *testing.T) {
+	for name, contents := range map[string]string{
+		"config.json": `{"role": "proxy", "allowed_targets": ["odoh.example.net"]}`,
+		"config.yml":  "role: proxy\nallowed_targets: [odoh.example.net]\n",
+	} {
+		path, cleanup := writeConfigFile(t, name, contents)
+		_, _, err := loadConfig([]string{"--config", path})
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), "allowed_targets") {
+			t.Errorf("%s: error %v, want an unknown allowed_targets setting", name, err)
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path, cleanup := writeConfigFile(t, "config.json", `{"role": "target", "port": "8443", "proxy": {"retry": {"max_attempts": 2}}}`)
+	defer cleanup()
+	defer setEnvironment(map[string]string{"PORT": "9443", "PROXY_RETRY_ATTEMPTS": "4"})()
+
+	for _, test := range []struct {
+		name        string
+		args        []string
+		port        string
+		maxAttempts int
+	}{
+		{name: "environment overrides file", args: []string{"--config", path}, port: "9443", maxAttempts: 4},
+		{name: "flags override environment", args: []string{"--config", path, "--port", "10443", "--proxy-retry-attempts", "5"}, port: "10443", maxAttempts: 5},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config, _, err := loadConfig(test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Role != roleTarget {
+				t.Errorf("role %q from the file, want %q", config.Role, roleTarget)
+			}
+			if config.Port != test.port || config.Proxy.Retry.MaxAttempts != test.maxAttempts {
+				t.Errorf("port %q and %d retry attempts, want %q and %d", config.Port, config.Proxy.Retry.MaxAttempts, test.port, test.maxAttempts)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsInvalidOverrides(t *testing.T) {
+	for _, test := range []struct {
+		environment map[string]string
+		args        []string
+		problem     string
+	}{
+		{
+			environment: map[string]string{"PROXY_RETRY_BURST": "many"},
+			problem:     `environment variable PROXY_RETRY_BURST: expected an integer, got "many"`,
+		},
+		{
+			args:    []string{"--proxy-retry-attempts", "3.5"},
+			problem: `flag --proxy-retry-attempts: expected an integer, got "3.5"`,
+		},
+	} {
+		restore := setEnvironment(test.environment)
+		_, _, err := loadConfig(test.args)
+		restore()
+		if err == nil || err.Error() != test.problem {
+			t.Errorf("error %v, want %s", err, test.problem)
+		}
+	}
+}
+
+func TestValidateRejections(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		role          string
+		allowCombined bool
+		allowlist     []string
+		allowAny      bool
+		problem       string
+	}{
+		{name: "missing role", problem: "role: must be"},
+		{name: "unknown role", role: "relay", problem: "role: must be"},
+		{name: "target", role: roleTarget},
+		{name: "combined without opt-in", role: roleCombined, allowlist: []string{"odoh.example.net"}, problem: "allow_combined"},
+		{name: "combined with opt-in", role: roleCombined, allowCombined: true, allowlist: []string{"odoh.example.net"}},
+		{name: "proxy without allowlist", role: roleProxy, problem: "proxy.allowed_targets"},
+		{name: "proxy with allowlist", role: roleProxy, allowlist: []string{"odoh.example.net"}},
+		{name: "proxy allowing any target", role: roleProxy, allowAny: true},
+		{name: "proxy with allowlist and allowing any target", role: roleProxy, allowlist: []string{"odoh.example.net"}, allowAny: true, problem: "proxy.allow_any_target"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := defaultServerConfig()
+			config.Role = test.role
+			config.AllowCombined = test.allowCombined
+			config.Proxy.AllowedTargets = test.allowlist
+			config.Proxy.AllowAnyTarget = test.allowAny
+			err := config.validate()
+			if test.problem == "" && err != nil {
+				t.Error(err)
+			}
+			if test.problem != "" && (err == nil || !strings.Contains(err.Error(), test.problem)) {
+				t.Errorf("error %v, want a %s problem", err, test.problem)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// discoveryDocument describes the endpoints of the server for clients and
+// operators, with URI templates expanded against the public proxy and
+// target URIs. Proxy templates are listed in order of preference. Only the
+// roles the server runs in are described.
+type discoveryDocument struct {
+	Proxy  *proxyDiscovery  `json:"proxy,omitempty"`
+	Target *targetDiscovery `json:"target,omitempty"`
+}
+
+type proxyDiscovery struct {
+	URITemplates      []string `json:"uri_templates"`
+	ConfigURITemplate string   `json:"config_uri_template"`
+}
+
+type targetDiscovery struct {
+	URITemplate string `json:"uri_template"`
+	ConfigsURI  string `json:"configs_uri"`
+}
+
+func newDiscoveryDocument(config serverConfig) discoveryDocument {
+	var document discoveryDocument
+	if config.runsProxy() {
+		proxyURI := strings.TrimRight(config.ProxyURI, "/")
+		document.Proxy = &proxyDiscovery{
+			URITemplates: []string{
+				proxyURI + config.Endpoints.ProxyTemplate,
+				proxyURI + legacyProxyTemplate(config.Endpoints.Proxy),
+			},
+			ConfigURITemplate: proxyURI + config.Endpoints.ProxyConfig + "{?targethost}",
+		}
+	}
+	if config.runsTarget() {
+		targetURI := strings.TrimRight(config.TargetURI, "/")
+		document.Target = &targetDiscovery{
+			URITemplate: targetURI + config.Endpoints.Query + "{?dns}",
+			ConfigsURI:  targetURI + config.Endpoints.Config,
+		}
+	}
+	return document
+}
+
+// legacyProxyTemplate returns the template of the proxy endpoint predating
+// RFC 9230, which takes both variables as query parameters.
+func legacyProxyTemplate(path string) string {
+	return path + "{?targethost,targetpath}"
+}
+
+func (d discoveryDocument) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s Handling %s\n", r.Method, r.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
@@ -8,4 +8,6 @@ require (
 	github.com/cisco/go-hpke v0.0.0-20201008152537-a07eeccbf5d5
 	github.com/elastic/go-elasticsearch/v8 v8.0.0-20201007143536-4b4020669208
 	github.com/miekg/dns v1.1.31
+	golang.org/x/net v0.0.0-20200813134508-3edf25e44fcc
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,194 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/chris-wood/odoh"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Largest DNS message that can be encoded (RFC 1035, Section 4.2.2)
+	maxDNSMessageSize = 65535
+
+	// Room for the ODoH message type, key ID, padding lengths and AEAD tag
+	obliviousEnvelopeOverhead = 1024
+
+	// Largest oblivious DNS message accepted from clients or targets
+	maxObliviousMessageSize = maxDNSMessageSize + obliviousEnvelopeOverhead
+
+	// Size of the buffers used to stream target responses to clients
+	copyBufferSize = 16 * 1024
+
+	// Time allowed to clients to send their request headers, to send a
+	// whole request, and between requests on a kept-alive connection
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
+var (
+	// Longest dns parameter of a DoH GET request (RFC 8484, Section 4.1)
+	maxDNSQueryParameterLength = base64.RawURLEncoding.EncodedLen(maxDNSMessageSize)
+
+	errBodyTooLarge     = errors.New("request body too large")
+	errQueryTooLarge    = errors.New("dns query parameter too large")
+	errResponseTooLarge = errors.New("response body too large")
+
+	// messageBuffers recycles the buffers holding the messages relayed by
+	// the proxy. Reads into them are limited, so they stay bounded in size.
+	messageBuffers = sync.Pool{
+		New: func() interface{} { return new(bytes.Buffer) },
+	}
+
+	// copyBuffers recycles the buffers streaming target responses.
+	copyBuffers = sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, copyBufferSize)
+			return &buf
+		},
+	}
+)
+
+// readLimitedBody reads at most limit bytes from body and fails with
+// errBodyTooLarge if there is more to read.
+func readLimitedBody(body io.Reader, limit int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
+}
+
+// readRequestBody reads the body of r, rejecting bodies larger than limit
+// before reading them when the client announces their length.
+func readRequestBody(r *http.Request, limit int64) ([]byte, error) {
+	defer r.Body.Close()
+	if r.ContentLength > limit {
+		return nil, errBodyTooLarge
+	}
+	return readLimitedBody(r.Body, limit)
+}
+
+// readPooledRequestBody is readRequestBody reading into a buffer from
+// messageBuffers, which the caller returns with releaseBuffer.
+func readPooledRequestBody(r *http.Request, limit int64) (*bytes.Buffer, error) {
+	defer r.Body.Close()
+	if r.ContentLength > limit {
+		return nil, errBodyTooLarge
+	}
+	buf := messageBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	if r.ContentLength > 0 {
+		buf.Grow(int(r.ContentLength))
+	}
+	if _, err := buf.ReadFrom(io.LimitReader(r.Body, limit+1)); err != nil {
+		releaseBuffer(buf)
+		return nil, err
+	}
+	if int64(buf.Len()) > limit {
+		releaseBuffer(buf)
+		return nil, errBodyTooLarge
+	}
+	return buf, nil
+}
+
+func releaseBuffer(buf *bytes.Buffer) {
+	messageBuffers.Put(buf)
+}
+
+// pooledBody is a request body backed by a buffer from messageBuffers. The
+// transport may still read the body after the response arrived, so the
+// buffer is only released when the transport closes the body.
+type pooledBody struct {
+	bytes.Reader
+	buf  *bytes.Buffer
+	once sync.Once
+}
+
+func newPooledBody(buf *bytes.Buffer) *pooledBody {
+	body := &pooledBody{buf: buf}
+	body.Reset(buf.Bytes())
+	return body
+}
+
+func (b *pooledBody) Close() error {
+	b.once.Do(func() {
+		releaseBuffer(b.buf)
+	})
+	return nil
+}
+
+// copyLimitedBody copies the response body to w through a buffer from
+// copyBuffers and fails with errResponseTooLarge, after copying limit bytes,
+// if body is longer.
+func copyLimitedBody(w io.Writer, body io.Reader, limit int64) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	// Hide any ReadFrom method of w, which would bypass the pooled buffer
+	written, err := io.CopyBuffer(struct{ io.Writer }{w}, io.LimitReader(body, limit), *buf)
+	if err != nil {
+		return written, err
+	}
+	if n, _ := io.ReadFull(body, (*buf)[:1]); n > 0 {
+		return written, errResponseTooLarge
+	}
+	return written, nil
+}
+
+// requestErrorStatus returns the status reported to a client whose request
+// could not be parsed because of err.
+func requestErrorStatus(err error) int {
+	if errors.Is(err, errBodyTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, errQueryTooLarge) {
+		return http.StatusRequestURITooLong
+	}
+	return http.StatusBadRequest
+}
+
+// unmarshalObliviousMessage decodes data as an oblivious DNS message of the
+// expected type.
+func unmarshalObliviousMessage(data []byte, expectedType odoh.ObliviousMessageType) (odoh.ObliviousDNSMessage, error) {
+	message, err := odoh.UnmarshalDNSMessage(data)
+	if err != nil {
+		return odoh.ObliviousDNSMessage{}, err
+	}
+	if message.Type() != expectedType {
+		return odoh.ObliviousDNSMessage{}, fmt.Errorf("unexpected oblivious message type %d, expected %d", message.Type(), expectedType)
+	}
+	return message, nil
+}
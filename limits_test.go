@@ -0,0 +1,111 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// relayReadAll relays a query and its response the way the proxy did before
+// pooling: both bodies are read whole into fresh slices.
+func relayReadAll(w io.Writer, r *http.Request, response io.Reader) error {
+	query, err := readRequestBody(r, maxObliviousMessageSize)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, bytes.NewReader(query)); err != nil {
+		return err
+	}
+	data, err := readLimitedBody(response, maxObliviousMessageSize)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// relayPooled relays a query and its response the way the proxy does now:
+// the query is read into a buffer from messageBuffers and the response is
+// streamed through a buffer from copyBuffers.
+func relayPooled(w io.Writer, r *http.Request, response io.Reader) error {
+	buf, err := readPooledRequestBody(r, maxObliviousMessageSize)
+	if err != nil {
+		return err
+	}
+	body := newPooledBody(buf)
+	_, err = io.Copy(ioutil.Discard, body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	_, err = copyLimitedBody(w, response, maxObliviousMessageSize)
+	return err
+}
+
+func benchmarkRelay(b *testing.B, relay func(io.Writer, *http.Request, io.Reader) error, size int) {
+	message := make([]byte, size)
+	query := bytes.NewReader(message)
+	response := bytes.NewReader(message)
+	r := &http.Request{Body: ioutil.NopCloser(query), ContentLength: int64(size)}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(2 * size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		query.Reset(message)
+		response.Reset(message)
+		if err := relay(ioutil.Discard, r, response); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRelayReadAllSmall(b *testing.B) { benchmarkRelay(b, relayReadAll, 512) }
+func BenchmarkRelayPooledSmall(b *testing.B)  { benchmarkRelay(b, relayPooled, 512) }
+func BenchmarkRelayReadAllLarge(b *testing.B) { benchmarkRelay(b, relayReadAll, maxDNSMessageSize) }
+func BenchmarkRelayPooledLarge(b *testing.B)  { benchmarkRelay(b, relayPooled, maxDNSMessageSize) }
+
+func TestCopyLimitedBody(t *testing.T) {
+	message := bytes.Repeat([]byte{1}, 100)
+	for _, test := range []struct {
+		limit int64
+		err   error
+	}{
+		{limit: 100},
+		{limit: 1000},
+		{limit: 99, err: errResponseTooLarge},
+	} {
+		var out bytes.Buffer
+		written, err := copyLimitedBody(&out, bytes.NewReader(message), test.limit)
+		if err != test.err {
+			t.Errorf("limit %d: error %v, want %v", test.limit, err, test.err)
+		}
+		if test.err == nil && (written != int64(len(message)) || !bytes.Equal(out.Bytes(), message)) {
+			t.Errorf("limit %d: copied %d bytes", test.limit, written)
+		}
+	}
+}
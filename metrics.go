@@ -0,0 +1,131 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// metrics is a set of named counters and duration summaries describing
+// the server's activity. It does not record anything about individual
+// clients or queries.
+type metrics struct {
+	sync.Mutex
+	counters  map[string]uint64
+	durations map[string]*durationSummary
+	sections  map[string]func() interface{}
+}
+
+type durationSummary struct {
+	Count uint64        `json:"count"`
+	Total time.Duration `json:"total_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		counters:  make(map[string]uint64),
+		durations: make(map[string]*durationSummary),
+		sections:  make(map[string]func() interface{}),
+	}
+}
+
+// addSection includes the value returned by snapshot under name in every
+// report, for state that is not a counter, such as connection pools.
+func (m *metrics) addSection(name string, snapshot func() interface{}) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	m.sections[name] = snapshot
+	m.Unlock()
+}
+
+func (m *metrics) increment(name string) {
+	m.add(name, 1)
+}
+
+func (m *metrics) add(name string, delta uint64) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	m.counters[name] += delta
+	m.Unlock()
+}
+
+// observe records duration in the summary called name.
+func (m *metrics) observe(name string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	summary, ok := m.durations[name]
+	if !ok {
+		summary = &durationSummary{}
+		m.durations[name] = summary
+	}
+	summary.Count++
+	summary.Total += duration
+	if duration > summary.Max {
+		summary.Max = duration
+	}
+}
+
+func (m *metrics) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s Handling %s\n", r.Method, r.URL.Path)
+
+	m.Lock()
+	snapshot := struct {
+		Counters  map[string]uint64          `json:"counters"`
+		Durations map[string]durationSummary `json:"durations"`
+		Sections  map[string]interface{}     `json:"sections,omitempty"`
+	}{
+		Counters:  make(map[string]uint64, len(m.counters)),
+		Durations: make(map[string]durationSummary, len(m.durations)),
+		Sections:  make(map[string]interface{}, len(m.sections)),
+	}
+	for name, count := range m.counters {
+		snapshot.Counters[name] = count
+	}
+	for name, summary := range m.durations {
+		snapshot.Durations[name] = *summary
+	}
+	sections := make(map[string]func() interface{}, len(m.sections))
+	for name, section := range m.sections {
+		sections[name] = section
+	}
+	m.Unlock()
+	for name, section := range sections {
+		snapshot.Sections[name] = section()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
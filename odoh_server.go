@@ -23,12 +23,15 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
 	"github.com/chris-wood/odoh"
 	"github.com/cisco/go-hpke"
+	"golang.org/x/net/http2"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"time"
@@ -40,32 +43,15 @@ const (
 	kdfID  = hpke.KDF_HKDF_SHA256
 	aeadID = hpke.AEAD_AESGCM128
 
-	// HTTP constants. Fill in your proxy and target here.
-	defaultPort = "8080"
-	proxyURI          = "https://dnstarget.example.net"
-	targetURI         = "https://dnsproxy.example.net"
-	queryEndpoint     = "/dns-query"
-	proxyEndpoint     = "/proxy"
-	healthEndpoint    = "/health"
-	configEndpoint 	  = "/.well-known/odohconfigs"
+	// Targets are few, so this only bounds memory if targethost is abused
+	maxRateLimitedTargets = 10000
 
 	// WebPvD configuration. Fill in your values here.
 	webPvDString = `"{ "identifier" : "github.com", "expires" : "2019-08-23T06:00:00Z", "prefixes" : [ ], "dnsZones" : [ "odoh.example.net" ] }"`
-
-	// Environment variables
-	secretSeedEnvironmentVariable = "SEED_SECRET_KEY"
-	targetNameEnvironmentVariable = "TARGET_INSTANCE_NAME"
-	experimentIDEnvironmentVariable = "EXPERIMENT_ID"
-	telemetryTypeEnvironmentVariable = "TELEMETRY_TYPE"
-)
-
-var (
-	// DNS constants. Fill in a DNS server to forward to here.
-	nameServers = []string{"1.1.1.1:53", "8.8.8.8:53", "9.9.9.9:53"}
 )
 
 type odohServer struct {
-	endpoints map[string]string
+	discovery discoveryDocument
 	Verbose   bool
 	target    *targetServer
 	DOHURI    string
@@ -73,10 +59,23 @@ type odohServer struct {
 
 func (s odohServer) indexHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("%s Handling %s\n", r.Method, r.URL.Path)
+	// Endpoints of the role this server does not run fall through to here
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
 	fmt.Fprint(w, "ODOH service\n")
 	fmt.Fprint(w, "----------------\n")
-	fmt.Fprintf(w, "Proxy endpoint: https://%s:%s/%s{?targethost,targetpath}\n", r.URL.Hostname(), r.URL.Port(), s.endpoints[proxyEndpoint])
-	fmt.Fprintf(w, "Target endpoint: https://%s:%s/%s{?dns}\n", r.URL.Hostname(), r.URL.Port(), s.endpoints[queryEndpoint])
+	if proxy := s.discovery.Proxy; proxy != nil {
+		for _, template := range proxy.URITemplates {
+			fmt.Fprintf(w, "Proxy endpoint: %s\n", template)
+		}
+		fmt.Fprintf(w, "Proxy config endpoint: %s\n", proxy.ConfigURITemplate)
+	}
+	if target := s.discovery.Target; target != nil {
+		fmt.Fprintf(w, "Target endpoint: %s\n", target.URITemplate)
+		fmt.Fprintf(w, "Target configs: %s\n", target.ConfigsURI)
+	}
 	fmt.Fprint(w, "----------------\n")
 }
 
@@ -86,15 +85,116 @@ func (s odohServer) healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = defaultPort
+	if len(os.Args) > 1 && os.Args[1] == "issue-tokens" {
+		if err := runTokenIssuer(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	config, printConfig, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if printConfig {
+		if err := config.print(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	serverMetrics := newMetrics()
+	server := odohServer{
+		discovery: newDiscoveryDocument(config),
+		Verbose:   config.Verbose,
+	}
+	router := &proxyTemplateRouter{next: http.DefaultServeMux}
+	// The admin listener serves what must not be public
+	admin := http.NewServeMux()
+	admin.HandleFunc(config.Endpoints.Metrics, serverMetrics.metricsHandler)
+
+	if config.runsTarget() {
+		target := newTargetServerFromConfig(config)
+		server.target = target
+		server.DOHURI = fmt.Sprintf("%s%s", config.TargetURI, config.Endpoints.Query)
+		http.HandleFunc(config.Endpoints.Query, target.targetQueryHandler)
+		http.HandleFunc(config.Endpoints.Config, target.configHandler)
+	}
+	if config.runsProxy() {
+		proxy := newProxyServerFromConfig(config, serverMetrics)
+		http.HandleFunc(config.Endpoints.ProxyConfig, proxy.proxyConfigHandler)
+		admin.HandleFunc("/target-pools", proxy.pools.poolsHandler)
+		for _, path := range []string{config.Endpoints.ProxyTemplate, legacyProxyTemplate(config.Endpoints.Proxy)} {
+			template, err := newProxyURITemplate(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			router.handle(template, proxy.proxyQueryHandler(template))
+		}
+	}
+	if config.Role == roleCombined {
+		log.Printf("WARNING: running as both proxy and target, which must only be done for testing")
+	} else {
+		log.Printf("Running as %s", config.Role)
+	}
+
+	http.HandleFunc(config.Endpoints.Health, server.healthCheckHandler)
+	http.HandleFunc(config.Endpoints.Discovery, server.discovery.discoveryHandler)
+	http.HandleFunc("/", server.indexHandler)
+
+	if config.AdminAddress != "" {
+		log.Printf("Serving admin endpoints on %v", config.AdminAddress)
+		go func() {
+			log.Fatal(newHTTPServer(config.AdminAddress, admin, config.Timeouts).ListenAndServe())
+		}()
+	}
+
+	log.Printf("Listening on port %v\n", config.Port)
+	if config.TLS.CertFile == "" {
+		log.Fatal(newHTTPServer(fmt.Sprintf(":%s", config.Port), router, config.Timeouts).ListenAndServe())
+	}
+	// Only targets authenticate proxies with client certificates
+	clientCAFile := ""
+	if config.runsTarget() {
+		clientCAFile = config.Target.ClientCAFile
+	}
+	certificates, err := newCertificateReloader(config.TLS.CertFile, config.TLS.KeyFile, serverMetrics)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificate: %v", err)
+	}
+	if interval := time.Duration(config.TLS.ReloadInterval); interval > 0 {
+		certificates.watch(interval)
+	}
+	serverTLS, err := newServerTLSConfig(certificates, clientCAFile)
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
+	listener := newHTTPServer(fmt.Sprintf(":%s", config.Port), router, config.Timeouts)
+	listener.TLSConfig = serverTLS
+	if err := http2.ConfigureServer(listener, nil); err != nil {
+		log.Fatalf("Failed to configure HTTP/2: %v", err)
+	}
+	log.Fatal(listener.ListenAndServeTLS("", ""))
+}
+
+// newHTTPServer returns a server for handler on address, enforcing timeouts.
+func newHTTPServer(address string, handler http.Handler, timeouts timeoutsConfig) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(timeouts.ReadHeader),
+		ReadTimeout:       time.Duration(timeouts.Read),
+		IdleTimeout:       time.Duration(timeouts.Idle),
 	}
+}
 
+// newTargetServerFromConfig creates the target, with its key pair, resolvers
+// and telemetry.
+func newTargetServerFromConfig(config serverConfig) *targetServer {
+	var err error
 	var seed []byte
-	if seedHex := os.Getenv(secretSeedEnvironmentVariable); seedHex != "" {
+	if seedHex := config.Target.SecretKeySeed; seedHex != "" {
 		log.Printf("Using Secret Key Seed : [%v]", seedHex)
-		var err error
 		seed, err = hex.DecodeString(seedHex)
 		if err != nil {
 			panic(err)
@@ -104,75 +204,193 @@ func main() {
 		rand.Read(seed)
 	}
 
-	var serverName string
-	if serverNameSetting := os.Getenv(targetNameEnvironmentVariable); serverNameSetting != "" {
-		serverName = serverNameSetting
-	} else {
-		serverName = "server_target_localhost"
-	}
+	serverName := config.Target.InstanceName
 	log.Printf("Setting Server Name as %v", serverName)
 
-	var experimentID string
-	if experimentID := os.Getenv(experimentIDEnvironmentVariable); experimentID == "" {
-		experimentID = "EXP_LOCAL"
-	}
-
-	var telemetryType string
-	if telemetryType := os.Getenv(telemetryTypeEnvironmentVariable); telemetryType == "" {
-		telemetryType = "LOG"
-	}
-
 	keyPair, err := odoh.CreateKeyPairFromSeed(kemID, kdfID, aeadID, seed)
 	if err != nil {
 		log.Fatal("Failed to create a private key. Exiting now.")
 	}
 
-	endpoints := make(map[string]string)
-	endpoints["Target"] = queryEndpoint
-	endpoints["Proxy"] = proxyEndpoint
-	endpoints["Health"] = healthEndpoint
-	endpoints["Config"] = configEndpoint
-
-	resolversInUse := make([]*targetResolver, len(nameServers))
-
-	for index := 0; index < len(nameServers); index++ {
-		resolver := &targetResolver{
-			timeout:    2500 * time.Millisecond,
-			nameserver: nameServers[index],
+	resolverTimeout := time.Duration(config.Target.ResolverTimeout)
+	var resolversInUse []queryResolver
+	if config.Target.Recursive.Enabled {
+		rootHints := config.Target.Recursive.RootHints
+		log.Printf("Resolving queries recursively from root hints %v", rootHints)
+		resolversInUse = []queryResolver{newRecursiveResolver(rootHints, config.Target.Recursive.AuthorityPort, resolverTimeout, time.Duration(config.Target.Recursive.ResolutionTimeout))}
+	} else {
+		nameServers := config.Target.NameServers
+		resolversInUse = make([]queryResolver, len(nameServers))
+		for index := 0; index < len(nameServers); index++ {
+			resolver := &targetResolver{
+				timeout:    resolverTimeout,
+				nameserver: nameServers[index],
+			}
+			resolversInUse[index] = resolver
 		}
-		resolversInUse[index] = resolver
 	}
 
 	target := &targetServer{
-		verbose:            false,
+		verbose:            config.Verbose,
 		resolver:           resolversInUse,
 		odohKeyPair:        keyPair,
-		telemetryClient:    getTelemetryInstance(telemetryType),
+		telemetryClient:    getTelemetryInstance(config.Telemetry),
 		serverInstanceName: serverName,
-		experimentId:       experimentID,
+		experimentId:       config.Target.ExperimentID,
+		blockedDomains:     config.Target.BlockedDomains,
+		dnssecProbes:       newTokenBucket(dnssecProbeRate, dnssecProbeRate),
 	}
 
+	if len(target.blockedDomains) > 0 {
+		log.Printf("Blocking queries for %v", target.blockedDomains)
+	}
+
+	if rateLimit := config.Target.QueryRateLimit; rateLimit > 0 {
+		target.queryLimiter = newTokenBucket(float64(rateLimit), rateLimit)
+	}
+
+	if cacheSize := config.Target.StaleCacheSize; cacheSize > 0 {
+		target.staleCache = newStaleAnswerCache(cacheSize, time.Duration(config.Target.StaleMaxAge))
+	}
+
+	if config.Target.DNS64.Enabled {
+		target.dns64, err = newDNS64Synthesizer(config.Target.DNS64.Prefix, config.Target.DNS64.Exclude)
+		if err != nil {
+			log.Fatalf("Failed to configure DNS64: %v", err)
+		}
+		log.Printf("Synthesizing AAAA records with prefix %v", config.Target.DNS64.Prefix)
+	}
+
+	if config.Target.ClientCAFile != "" {
+		target.proxyAuth = newProxyAuthenticator(config.Target.AllowedProxies)
+		log.Printf("Only accepting queries from proxies with client certificates %v", config.Target.AllowedProxies)
+	}
+
+	return target
+}
+
+// newProxyServerFromConfig creates the proxy, with its connections to
+// targets, and starts its cover traffic.
+func newProxyServerFromConfig(config serverConfig, serverMetrics *metrics) *proxyServer {
+	resolverConfig := config.Proxy.Resolver
+	hosts, err := newHostResolver(resolverConfig.NameServers, resolverConfig.StaticHosts, time.Duration(resolverConfig.Timeout),
+		time.Duration(resolverConfig.MinTTL), time.Duration(resolverConfig.MaxTTL), serverMetrics)
+	if err != nil {
+		log.Fatalf("Failed to configure the proxy resolver: %v", err)
+	}
+	if len(resolverConfig.NameServers) > 0 {
+		log.Printf("Resolving target hosts with %v", resolverConfig.NameServers)
+	}
+	policy := newTargetPolicy(config.Proxy.AllowedTargets, config.Proxy.AllowAnyTarget, config.Proxy.AllowPrivateTargets, hosts)
+	if config.Proxy.AllowAnyTarget {
+		log.Printf("No target allowlist configured, proxying to any public target")
+	}
+	headers, err := newHeaderPolicy(config.Proxy.ForwardedHeaders)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(config.Proxy.ConnectTimeout),
+		KeepAlive: time.Duration(config.Proxy.Transport.KeepAlive),
+		Control:   policy.dialControl,
+	}
+	proxyTLS, err := newProxyTLSConfig(config.Proxy.ClientCertFile, config.Proxy.ClientKeyFile, config.Proxy.TargetCAFile)
+	if err != nil {
+		log.Fatalf("Failed to configure proxy TLS: %v", err)
+	}
+	tlsClient, err := newPinnedTLSClient(proxyTLS, time.Duration(config.Proxy.TLSHandshakeTimeout), config.Proxy.TargetPins, config.Proxy.PinReportOnly, serverMetrics)
+	if err != nil {
+		log.Fatalf("Failed to configure target pins: %v", err)
+	}
+	if len(config.Proxy.TargetPins) > 0 {
+		log.Printf("Pinning the keys of %d targets (report only: %v)", len(config.Proxy.TargetPins), config.Proxy.PinReportOnly)
+	}
+	targetDialer := &targetDialer{
+		resolve:     policy.resolveTarget,
+		dialer:      dialer,
+		tls:         tlsClient,
+		maxAttempts: config.Proxy.Retry.MaxAttempts,
+		minBackoff:  time.Duration(config.Proxy.Retry.MinBackoff),
+		maxBackoff:  time.Duration(config.Proxy.Retry.MaxBackoff),
+		metrics:     serverMetrics,
+	}
+	if budget := config.Proxy.Retry.Budget; budget.Rate > 0 {
+		targetDialer.budget = newTokenBucket(budget.Rate, budget.Burst)
+	}
+	poolStats := newPoolStatistics()
+	serverMetrics.addSection("proxy_target_pools", poolStats.totals)
+	transport := newProxyTransport(config.Proxy.Transport, targetDialer, config.Proxy.MaxIdleConnsPerHost, poolStats)
 	proxy := &proxyServer{
 		client: &http.Client{
-			Transport: &http.Transport{
-				MaxIdleConnsPerHost: 1024,
-				TLSHandshakeTimeout: 0 * time.Second,
-			},
+			Transport: transport,
 		},
+		timeout: time.Duration(config.Proxy.RequestTimeout),
+		policy:  policy,
+		headers: headers,
+		metrics: serverMetrics,
+		pools:   poolStats,
 	}
-
-	server := odohServer{
-		endpoints: endpoints,
-		target:    target,
-		DOHURI:    fmt.Sprintf("%s/%s", targetURI, queryEndpoint),
+	if limit := config.Proxy.ClientRateLimit; limit.Rate > 0 {
+		proxy.clientLimiter = newKeyedRateLimiter(limit.Rate, limit.Burst, config.Proxy.MaxRateLimitedClients)
+	}
+	if limit := config.Proxy.TargetRateLimit; limit.Rate > 0 {
+		proxy.targetLimiter = newKeyedRateLimiter(limit.Rate, limit.Burst, maxRateLimitedTargets)
+	}
+	if mixing := config.Proxy.Mixing; mixing.Mode != "" {
+		log.Printf("Mixing proxied requests in %s mode, adding at most %v", mixing.Mode, time.Duration(mixing.MaxDelay))
+		proxy.mixer = newRequestMixer(mixing.Mode, time.Duration(mixing.MinDelay), time.Duration(mixing.MaxDelay), mixing.BatchSize, serverMetrics)
+	}
+	if config.Proxy.NextHop != "" {
+		proxy.nextHop, err = newNextHopProxy(config.Proxy.NextHop)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Forwarding proxied requests through %s", config.Proxy.NextHop)
+	}
+	if tokens := config.Proxy.Tokens; tokens.IssuerKeyFile != "" {
+		issuerKey, err := loadTokenKey(tokens.IssuerKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		proxy.tokens, err = newTokenVerifier(issuerKey, tokens.IssuerName, tokens.OriginInfo, tokens.StoreDir, serverMetrics)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Requiring PrivateTokens from issuer %s", tokens.IssuerName)
+		if tokens.StoreDir == "" {
+			log.Printf("Keeping redeemed tokens in memory: set proxy.tokens.store_dir to keep them across restarts and replicas")
+		}
+	}
+	proxy.configs = newTargetConfigCache(proxy.client, proxy.nextHop)
+	if config.Proxy.RequireTargetConfigs {
+		policy.configs = proxy.configs
+	}
+	if cover := config.Proxy.CoverTraffic; cover.Rate > 0 {
+		names := cover.Names
+		if len(names) == 0 {
+			names = defaultCoverNames
+		}
+		proxy.querySamples = newClientQuerySamples(headers)
+		generator := &coverTrafficGenerator{
+			client:     proxy.client,
+			headers:    headers,
+			samples:    proxy.querySamples,
+			configs:    proxy.configs,
+			targets:    policy.allowedHosts,
+			targetPath: cover.TargetPath,
+			rate:       cover.Rate,
+			names:      names,
+			timeout:    proxy.timeout,
+			nextHop:    proxy.nextHop,
+			metrics:    serverMetrics,
+		}
+		if len(generator.targets) == 0 {
+			log.Printf("Cover traffic enabled but no target host is allowlisted by name, sending none")
+		} else {
+			log.Printf("Sending %v cover queries per second to each of %v", cover.Rate, generator.targets)
+		}
+		generator.run(context.Background())
 	}
 
-	http.HandleFunc(queryEndpoint, target.targetQueryHandler)
-	http.HandleFunc(proxyEndpoint, proxy.proxyQueryHandler)
-	http.HandleFunc(healthEndpoint, server.healthCheckHandler)
-	http.HandleFunc(configEndpoint, target.configHandler)
-	http.HandleFunc("/", server.indexHandler)
-
-	log.Printf("Listening on port %v\n", port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+	return proxy
 }
@@ -23,74 +23,346 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"errors"
-	"io/ioutil"
+	"fmt"
+	"github.com/chris-wood/odoh"
+	"github.com/miekg/dns"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type proxyServer struct {
-	client *http.Client
+	client        *http.Client
+	timeout       time.Duration
+	policy        *targetPolicy
+	headers       *headerPolicy
+	clientLimiter *keyedRateLimiter
+	targetLimiter *keyedRateLimiter
+	metrics       *metrics
+	mixer         *requestMixer
+	configs       *targetConfigCache
+	nextHop       *nextHopProxy
+	tokens        *tokenVerifier
+	pools         *poolStatistics
+	querySamples  *clientQuerySamples
 }
 
-func forwardProxyRequest(client *http.Client, targetName string, targetPath string, body []byte, headerContentType string) ([]byte, error) {
-	req, err := http.NewRequest("POST", "https://"+targetName+targetPath, bytes.NewReader(body))
+// proxyResponse is the target's answer to a forwarded request. Its body is
+// streamed from the target and must be closed by the caller.
+type proxyResponse struct {
+	statusCode    int
+	header        http.Header
+	body          io.ReadCloser
+	contentLength int64
+}
+
+// forwardProxyRequest sends the contentLength bytes of body to the target.
+// Responses announcing a body larger than an oblivious message are refused
+// before reading them; the length of other bodies is enforced while they
+// are streamed with copyLimitedBody.
+func forwardProxyRequest(ctx context.Context, client *http.Client, targetURL string, body io.Reader, contentLength int64, header http.Header) (*proxyResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", targetURL, body)
 	if err != nil {
 		log.Println("Failed creating target POST request")
 		return nil, errors.New("failed creating target POST request")
 	}
-	req.Header.Set("Content-Type", headerContentType)
+	req.ContentLength = contentLength
+	req.Header = header
 
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("Failed to send proxied message %v\n", err)
-		return nil, errors.New("failed to send proxied message")
+		return nil, err
+	}
+	if resp.ContentLength > maxObliviousMessageSize {
+		resp.Body.Close()
+		log.Printf("Proxied response of %d bytes is too large\n", resp.ContentLength)
+		return nil, errResponseTooLarge
+	}
+
+	return &proxyResponse{
+		statusCode:    resp.StatusCode,
+		header:        resp.Header,
+		body:          resp.Body,
+		contentLength: resp.ContentLength,
+	}, nil
+}
+
+// forwardedRequestHeader returns the headers of the request forwarded to
+// the target for a client request with clientHeader. Cover queries build
+// their headers here too, from those of a relayed query.
+func forwardedRequestHeader(headers *headerPolicy, nextHop *nextHopProxy, clientHeader http.Header) http.Header {
+	header := headers.targetRequestHeaders(clientHeader)
+	if nextHop != nil {
+		nextHop.addVia(header, clientHeader)
+	}
+	return header
+}
+
+// validateTargetHost checks that targetHost is a host name or IP address
+// with an optional port, and nothing that would change the forwarded URL.
+func validateTargetHost(targetHost string) error {
+	hostname := targetHost
+	if host, port, err := net.SplitHostPort(targetHost); err == nil {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("invalid port in targethost %q", targetHost)
+		}
+		hostname = host
+	}
+	if net.ParseIP(hostname) != nil {
+		return nil
+	}
+	if _, ok := dns.IsDomainName(hostname); !ok || hostname == "" {
+		return fmt.Errorf("invalid targethost %q", targetHost)
+	}
+	for _, c := range hostname {
+		if !(c == '-' || c == '.' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')) {
+			return fmt.Errorf("invalid character %q in targethost", c)
+		}
+	}
+	return nil
+}
+
+// validateTargetPath checks that targetPath is an absolute path without a
+// query or fragment.
+func validateTargetPath(targetPath string) error {
+	if !strings.HasPrefix(targetPath, "/") || strings.HasPrefix(targetPath, "//") {
+		return fmt.Errorf("targetpath %q is not an absolute path", targetPath)
+	}
+	parsed, err := url.Parse(targetPath)
+	if err != nil {
+		return err
 	}
-	defer resp.Body.Close()
+	if parsed.Scheme != "" || parsed.Host != "" || parsed.RawQuery != "" || parsed.Fragment != "" || strings.Contains(targetPath, "?") {
+		return fmt.Errorf("targetpath %q must only contain a path", targetPath)
+	}
+	return nil
+}
 
-	responseBody, err := ioutil.ReadAll(resp.Body)
-	return responseBody, err
+// forwardingErrorStatus maps an error talking to the target to the status
+// returned to the client: 504 if the target timed out, 502 otherwise.
+func forwardingErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
 }
 
-func (p *proxyServer) proxyQueryHandler(w http.ResponseWriter, r *http.Request) {
+// proxyQueryHandler serves the requests matching template.
+func (p *proxyServer) proxyQueryHandler(template *proxyURITemplate) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		targetName, targetPath, err := template.match(r)
+		if err != nil {
+			log.Println("Rejecting proxy request:", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodGet && targetPath == odohConfigsWellKnownPath {
+			p.serveProxyConfig(w, r, targetName)
+			return
+		}
+		p.serveProxyQuery(w, r, targetName, targetPath)
+	}
+}
+
+func (p *proxyServer) serveProxyQuery(w http.ResponseWriter, r *http.Request, targetName string, targetPath string) {
 	log.Printf("%s Handling %s\n", r.Method, r.URL.Path)
 
+	if p.clientLimiter != nil {
+		if allowed, wait := p.clientLimiter.reserve(clientRateLimitKey(r.RemoteAddr)); !allowed {
+			p.metrics.increment("proxy_rate_limited_client")
+			writeRateLimited(w, wait)
+			return
+		}
+	}
+
 	if r.Method != "POST" {
 		log.Printf("Unsupported method for %s", r.URL.Path)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	targetName := r.URL.Query().Get("targethost")
+	var tokenNonce []byte
+	if p.tokens != nil {
+		var ok bool
+		if tokenNonce, ok = p.tokens.authorize(w, r); !ok {
+			return
+		}
+	}
+
+	if err := checkProxyHops(r.Header, p.nextHop); err != nil {
+		log.Println("Rejecting proxy request:", err)
+		p.metrics.increment("proxy_loop_detected")
+		http.Error(w, http.StatusText(http.StatusLoopDetected), http.StatusLoopDetected)
+		return
+	}
+
 	if targetName == "" {
-		log.Println("Missing proxy targethost query parameter in POST request")
+		log.Println("Missing proxy targethost in POST request")
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateTargetHost(targetName); err != nil {
+		log.Println("Rejecting proxy request:", err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	targetPath := r.URL.Query().Get("targetpath")
 	if targetPath == "" {
-		log.Println("Missing proxy targetpath query parameter in POST request")
+		log.Println("Missing proxy targetpath in POST request")
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	defer r.Body.Close()
-	body, err := ioutil.ReadAll(r.Body)
+	if err := validateTargetPath(targetPath); err != nil {
+		log.Println("Rejecting proxy request:", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := p.headers.checkClientRequest(r.Header); err != nil {
+		log.Println("Rejecting proxy request:", err)
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	buf, err := readPooledRequestBody(r, maxObliviousMessageSize)
 	if err != nil {
-		log.Println("Missing proxy message body in POST request")
+		log.Println("Failed reading proxy message body in POST request:", err)
+		status := requestErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	// Once forwarded, the transport releases the body when it is done with
+	// it; until then every return releases it here.
+	body := newPooledBody(buf)
+	forwarded := false
+	defer func() {
+		if !forwarded {
+			body.Close()
+		}
+	}()
+
+	if _, err := unmarshalObliviousMessage(buf.Bytes(), odoh.QueryType); err != nil {
+		log.Println("Proxy message body is not an oblivious DNS query:", err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	headerContentType := r.Header.Get("Content-Type")
+	// Outbound work is bound to the client's request, so that it is
+	// abandoned as soon as the client goes away, and to the proxy deadline.
+	ctx := r.Context()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
 
-	responseBody, err := forwardProxyRequest(p.client, targetName, targetPath, body, headerContentType)
+	// When chaining, the next hop connects to the target and enforces its
+	// own policy; only the allowlist is checked here.
+	checkTarget := p.policy.checkTarget
+	if p.nextHop != nil {
+		checkTarget = p.policy.checkTargetName
+	}
+	if err := checkTarget(ctx, targetName); err != nil {
+		log.Printf("Refusing to proxy to %s: %v", targetName, err)
+		if errors.Is(err, errUnresolvedTarget) {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		} else {
+			http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(http.StatusForbidden), err), http.StatusForbidden)
+		}
+		return
+	}
+
+	// Only targets the proxy would relay to count against the target rate
+	// limits, so that refused names cannot crowd out allowed targets.
+	if p.targetLimiter != nil {
+		if allowed, wait := p.targetLimiter.reserve(strings.ToLower(targetHostname(targetName))); !allowed {
+			log.Printf("Rate limiting requests to %s", targetName)
+			p.metrics.increment("proxy_rate_limited_target")
+			writeRateLimited(w, wait)
+			return
+		}
+	}
+
+	if p.tokens != nil && !p.tokens.redeem(w, tokenNonce) {
+		return
+	}
+
+	if p.mixer != nil {
+		if err := p.mixer.wait(ctx); err != nil {
+			if r.Context().Err() == context.Canceled {
+				p.metrics.increment("proxy_client_cancelled")
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+			return
+		}
+	}
+
+	targetURL, err := forwardingURL(p.nextHop, targetName, targetPath)
 	if err != nil {
+		log.Printf("Failed building forwarding URL for %s: %v", targetName, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", headerContentType)
-	w.Write(responseBody)
+	header := forwardedRequestHeader(p.headers, p.nextHop, r.Header)
+	p.querySamples.record(buf.Len(), r.Header)
+
+	forwarded = true
+	response, err := forwardProxyRequest(ctx, p.client, targetURL, body, int64(buf.Len()), header)
+	if err != nil {
+		if r.Context().Err() == context.Canceled {
+			log.Printf("Client cancelled request to %s", targetName)
+			p.metrics.increment("proxy_client_cancelled")
+			return
+		}
+		status := forwardingErrorStatus(err)
+		if status == http.StatusGatewayTimeout {
+			p.metrics.increment("proxy_target_timeout")
+		} else {
+			p.metrics.increment("proxy_target_error")
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	defer response.body.Close()
+	p.metrics.increment("proxy_requests_forwarded")
+
+	responseHeader, err := p.headers.clientResponseHeaders(response.statusCode, response.header)
+	if err != nil {
+		log.Println("Rejecting target response:", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	for name, values := range responseHeader {
+		w.Header()[name] = values
+	}
+	if response.contentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(response.contentLength, 10))
+	}
+	w.WriteHeader(response.statusCode)
+
+	// The status is already sent, so a response that fails or turns out too
+	// large midway can only be reported by aborting the client's stream.
+	if _, err := copyLimitedBody(w, response.body, maxObliviousMessageSize); err != nil {
+		if r.Context().Err() == context.Canceled {
+			p.metrics.increment("proxy_client_cancelled")
+		} else {
+			log.Printf("Failed relaying response from %s: %v", targetName, err)
+			p.metrics.increment("proxy_response_aborted")
+		}
+		panic(http.ErrAbortHandler)
+	}
 }
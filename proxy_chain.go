@@ -0,0 +1,129 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// Most proxies a request may have crossed before reaching this one
+	maxProxyHops = 4
+)
+
+var (
+	errProxyLoop      = errors.New("request already crossed this proxy")
+	errTooManyHops    = errors.New("request crossed too many proxies")
+	errInvalidNextHop = errors.New("next hop must be an https URI template with targethost and targetpath variables")
+)
+
+// nextHopProxy is another proxy that requests are forwarded to instead of
+// the target, so that no single operator sees both the client address and
+// the target. The final targethost and targetpath are carried through the
+// template's variables.
+type nextHopProxy struct {
+	template string
+	// Pseudonym this proxy adds to the Via header of forwarded requests
+	pseudonym string
+}
+
+// newNextHopProxy checks that template is an https URI template carrying
+// the target variables.
+func newNextHopProxy(template string) (*nextHopProxy, error) {
+	variables := make(map[string]bool)
+	for _, name := range uriTemplateVariables(template) {
+		variables[name] = true
+	}
+	if !variables["targethost"] || !variables["targetpath"] {
+		return nil, errInvalidNextHop
+	}
+	expanded, err := expandURITemplate(template, map[string]string{"targethost": "example.net", "targetpath": "/dns-query"})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidNextHop, err)
+	}
+	parsed, err := url.Parse(expanded)
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return nil, errInvalidNextHop
+	}
+	return &nextHopProxy{
+		template:  template,
+		pseudonym: fmt.Sprintf("odoh-%016x", randomUint64()),
+	}, nil
+}
+
+func (h *nextHopProxy) requestURL(targetName string, targetPath string) (string, error) {
+	return expandURITemplate(h.template, map[string]string{
+		"targethost": targetName,
+		"targetpath": targetPath,
+	})
+}
+
+// addVia records this proxy in the Via header sent to the next hop, after
+// the proxies the client request already crossed.
+func (h *nextHopProxy) addVia(header http.Header, clientHeader http.Header) {
+	hops := append(viaEntries(clientHeader), "1.1 "+h.pseudonym)
+	header.Set("Via", strings.Join(hops, ", "))
+}
+
+func viaEntries(header http.Header) []string {
+	var entries []string
+	for _, value := range header.Values("Via") {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+// checkProxyHops rejects requests that crossed too many proxies or, if the
+// proxy forwards to another one, that already crossed this proxy.
+func checkProxyHops(clientHeader http.Header, nextHop *nextHopProxy) error {
+	entries := viaEntries(clientHeader)
+	if len(entries) >= maxProxyHops {
+		return errTooManyHops
+	}
+	if nextHop != nil {
+		for _, entry := range entries {
+			fields := strings.Fields(entry)
+			if len(fields) >= 2 && fields[1] == nextHop.pseudonym {
+				return errProxyLoop
+			}
+		}
+	}
+	return nil
+}
+
+// forwardingURL returns where a request for targetName and targetPath is
+// sent: the next hop proxy if there is one, the target otherwise.
+func forwardingURL(nextHop *nextHopProxy, targetName string, targetPath string) (string, error) {
+	if nextHop != nil {
+		return nextHop.requestURL(targetName, targetPath)
+	}
+	return "https://" + targetName + targetPath, nil
+}
@@ -0,0 +1,292 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/chris-wood/odoh"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	odohConfigsWellKnownPath = "/.well-known/odohconfigs"
+
+	// How long a target configuration is trusted when the target does not
+	// advertise a lifetime, and the longest lifetime the proxy accepts
+	targetConfigLifetime    = time.Hour
+	maxTargetConfigLifetime = 24 * time.Hour
+
+	// Most targets whose configurations are remembered at once
+	maxCachedTargetConfigs = 10000
+)
+
+type cachedTargetConfigs struct {
+	configs odoh.ObliviousDoHConfigs
+	raw     []byte
+	expires time.Time
+}
+
+// advertisedConfigLifetime returns how long the target allows its published
+// configurations to be cached, according to the Cache-Control header.
+func advertisedConfigLifetime(header http.Header) time.Duration {
+	lifetime := targetConfigLifetime
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.ParseUint(strings.TrimPrefix(directive, "max-age="), 10, 32)
+			if err != nil {
+				return 0
+			}
+			lifetime = time.Duration(seconds) * time.Second
+		}
+	}
+	if lifetime > maxTargetConfigLifetime {
+		lifetime = maxTargetConfigLifetime
+	}
+	return lifetime
+}
+
+// targetConfigCache remembers the ODoH configurations published by targets.
+// When chaining, configurations are fetched through the next hop, like
+// queries, so that the target never sees this proxy's address.
+type targetConfigCache struct {
+	sync.Mutex
+	client  *http.Client
+	nextHop *nextHopProxy
+	entries map[string]cachedTargetConfigs
+}
+
+func newTargetConfigCache(client *http.Client, nextHop *nextHopProxy) *targetConfigCache {
+	return &targetConfigCache{
+		client:  client,
+		nextHop: nextHop,
+		entries: make(map[string]cachedTargetConfigs),
+	}
+}
+
+func (c *targetConfigCache) fetch(ctx context.Context, targetHost string) (cachedTargetConfigs, error) {
+	configsURL, err := forwardingURL(c.nextHop, targetHost, odohConfigsWellKnownPath)
+	if err != nil {
+		return cachedTargetConfigs{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, configsURL, nil)
+	if err != nil {
+		return cachedTargetConfigs{}, err
+	}
+	req.Header.Set("User-Agent", proxyUserAgent)
+	if c.nextHop != nil {
+		c.nextHop.addVia(req.Header, nil)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return cachedTargetConfigs{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return cachedTargetConfigs{}, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	body, err := readLimitedBody(resp.Body, maxDNSMessageSize)
+	if err != nil {
+		return cachedTargetConfigs{}, err
+	}
+	configs, err := odoh.UnmarshalObliviousDoHConfigs(body)
+	if err != nil {
+		return cachedTargetConfigs{}, err
+	}
+	if len(configs.Configs) == 0 {
+		return cachedTargetConfigs{}, errors.New("no supported configurations")
+	}
+	return cachedTargetConfigs{
+		configs: configs,
+		raw:     body,
+		expires: time.Now().Add(advertisedConfigLifetime(resp.Header)),
+	}, nil
+}
+
+// lookup returns the configurations of targetHost, fetching them unless a
+// previous fetch is still within its advertised lifetime.
+func (c *targetConfigCache) lookup(ctx context.Context, targetHost string) (cachedTargetConfigs, error) {
+	c.Lock()
+	entry, ok := c.entries[targetHost]
+	c.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry, nil
+	}
+
+	entry, err := c.fetch(ctx, targetHost)
+	if err != nil {
+		return cachedTargetConfigs{}, err
+	}
+
+	c.Lock()
+	if len(c.entries) >= maxCachedTargetConfigs {
+		c.evict()
+	}
+	c.entries[targetHost] = entry
+	c.Unlock()
+	return entry, nil
+}
+
+// evict makes room for a new entry, dropping expired entries or, if there
+// are none, an arbitrary one. It must be called with the lock held.
+func (c *targetConfigCache) evict() {
+	now := time.Now()
+	for host, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, host)
+		}
+	}
+	for host := range c.entries {
+		if len(c.entries) < maxCachedTargetConfigs {
+			break
+		}
+		delete(c.entries, host)
+	}
+}
+
+// get returns the parsed configurations of targetHost.
+func (c *targetConfigCache) get(ctx context.Context, targetHost string) (odoh.ObliviousDoHConfigs, error) {
+	entry, err := c.lookup(ctx, targetHost)
+	if err != nil {
+		return odoh.ObliviousDoHConfigs{}, err
+	}
+	return entry.configs, nil
+}
+
+// checkTarget verifies that targetHost publishes a valid configuration.
+func (c *targetConfigCache) checkTarget(ctx context.Context, targetHost string) error {
+	if _, err := c.get(ctx, targetHost); err != nil {
+		log.Printf("Failed fetching ODoH configuration of %s: %v", targetHost, err)
+		return errUnknownTarget
+	}
+	return nil
+}
+
+// proxyConfigHandler relays the configurations published by a target, so
+// that clients can discover them without revealing their address to it.
+func (p *proxyServer) proxyConfigHandler(w http.ResponseWriter, r *http.Request) {
+	p.serveProxyConfig(w, r, r.URL.Query().Get("targethost"))
+}
+
+// serveProxyConfig relays the configurations of targetName. Besides the
+// config endpoint, it serves the configuration fetches of proxies chaining
+// to this one, sent to the query endpoint with the well-known path.
+func (p *proxyServer) serveProxyConfig(w http.ResponseWriter, r *http.Request, targetName string) {
+	log.Printf("%s Handling %s\n", r.Method, r.URL.Path)
+
+	if p.clientLimiter != nil {
+		if allowed, wait := p.clientLimiter.reserve(clientRateLimitKey(r.RemoteAddr)); !allowed {
+			p.metrics.increment("proxy_rate_limited_client")
+			writeRateLimited(w, wait)
+			return
+		}
+	}
+
+	if r.Method != http.MethodGet {
+		log.Printf("Unsupported method for %s", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var tokenNonce []byte
+	if p.tokens != nil {
+		var ok bool
+		if tokenNonce, ok = p.tokens.authorize(w, r); !ok {
+			return
+		}
+	}
+
+	if err := checkProxyHops(r.Header, p.nextHop); err != nil {
+		log.Println("Rejecting config request:", err)
+		p.metrics.increment("proxy_loop_detected")
+		http.Error(w, http.StatusText(http.StatusLoopDetected), http.StatusLoopDetected)
+		return
+	}
+
+	if targetName == "" {
+		log.Println("Missing targethost query parameter in config request")
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err := validateTargetHost(targetName); err != nil {
+		log.Println("Rejecting config request:", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	// When chaining, the next hop fetches the configurations and enforces
+	// its own policy; only the allowlist is checked here.
+	checkTarget := p.policy.checkTarget
+	if p.nextHop != nil {
+		checkTarget = p.policy.checkTargetName
+	}
+	if err := checkTarget(ctx, targetName); err != nil {
+		log.Printf("Refusing to relay configurations of %s: %v", targetName, err)
+		if errors.Is(err, errUnresolvedTarget) || errors.Is(err, errUnknownTarget) {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		} else {
+			http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(http.StatusForbidden), err), http.StatusForbidden)
+		}
+		return
+	}
+
+	if p.tokens != nil && !p.tokens.redeem(w, tokenNonce) {
+		return
+	}
+
+	entry, err := p.configs.lookup(ctx, targetName)
+	if err != nil {
+		log.Printf("Failed fetching ODoH configuration of %s: %v", targetName, err)
+		p.metrics.increment("proxy_config_fetch_error")
+		status := forwardingErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	p.metrics.increment("proxy_config_relayed")
+
+	maxAge := time.Until(entry.expires) / time.Second
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	w.Header().Set("Content-Type", obliviousDNSMessageContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+	w.Write(entry.raw)
+}
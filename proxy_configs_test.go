@@ -0,0 +1,105 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"github.com/chris-wood/odoh"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestChainedConfigFetch(t *testing.T) {
+	keyPair, err := odoh.CreateKeyPairFromSeed(kemID, kdfID, aeadID, make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &targetServer{odohKeyPair: keyPair}
+	targetHTTP := httptest.NewTLSServer(http.HandlerFunc(target.configHandler))
+	defer targetHTTP.Close()
+	targetName := strings.TrimPrefix(targetHTTP.URL, "https://")
+
+	// The next hop connects to the target on a loopback address, which only
+	// its own policy allows.
+	template, err := newProxyURITemplate("/proxy{?targethost,targetpath}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, err := newHeaderPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextHopProxy := &proxyServer{
+		client:  targetHTTP.Client(),
+		policy:  newTargetPolicy(nil, true, true, nil),
+		headers: headers,
+		configs: newTargetConfigCache(targetHTTP.Client(), nil),
+	}
+	var via string
+	nextHopServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		via = r.Header.Get("Via")
+		nextHopProxy.proxyQueryHandler(template)(w, r)
+	}))
+	defer nextHopServer.Close()
+
+	nextHop, err := newNextHopProxy(nextHopServer.URL + "/proxy{?targethost,targetpath}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &proxyServer{
+		client:  nextHopServer.Client(),
+		policy:  newTargetPolicy(nil, true, false, nil),
+		headers: headers,
+		configs: newTargetConfigCache(nextHopServer.Client(), nextHop),
+		nextHop: nextHop,
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/proxy-configs?targethost="+url.QueryEscape(targetName), nil)
+	w := httptest.NewRecorder()
+	proxy.proxyConfigHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	want := odoh.CreateObliviousDoHConfigs([]odoh.ObliviousDoHConfig{keyPair.Config}).Marshal()
+	if !bytes.Equal(w.Body.Bytes(), want) {
+		t.Errorf("relayed configurations %x, want %x", w.Body.Bytes(), want)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != obliviousDNSMessageContentType {
+		t.Errorf("relayed configurations with Content-Type %q, want %q", contentType, obliviousDNSMessageContentType)
+	}
+	if !strings.HasSuffix(via, nextHop.pseudonym) {
+		t.Errorf("next hop saw Via %q, want this proxy", via)
+	}
+
+	// Without a next hop, the proxy applies its whole policy.
+	proxy.nextHop = nil
+	proxy.configs = newTargetConfigCache(targetHTTP.Client(), nil)
+	w = httptest.NewRecorder()
+	proxy.proxyConfigHandler(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("unchained fetch from a private address: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,259 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/chris-wood/odoh"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCoverTargetPath = "/dns-query"
+	// Relayed queries whose shape cover queries are drawn from
+	maxClientQuerySamples = 256
+	// Cover queries are padded to a multiple of this many bytes until a
+	// query has been relayed (RFC 8467, Section 4.1)
+	coverPaddingBlockSize = 128
+)
+
+// Names queried by cover traffic when none are configured
+var defaultCoverNames = []string{
+	"example.com.",
+	"example.net.",
+	"example.org.",
+	"wikipedia.org.",
+	"cloudflare.com.",
+	"apple.com.",
+}
+
+// coverTrafficGenerator sends dummy oblivious queries to every allowlisted
+// target so that an observer of the proxy's egress cannot learn how many
+// real queries each target receives. Dummy queries are sealed with the
+// target's published configuration, padded to the size of a recently relayed
+// query and sent with its headers, so that they are indistinguishable on the
+// wire from relayed ones; their answers are discarded.
+type coverTrafficGenerator struct {
+	client     *http.Client
+	headers    *headerPolicy
+	samples    *clientQuerySamples
+	configs    *targetConfigCache
+	targets    []string
+	targetPath string
+	rate       float64
+	names      []string
+	timeout    time.Duration
+	nextHop    *nextHopProxy
+	metrics    *metrics
+}
+
+// clientQuerySample is the shape of a relayed query: the size of its sealed
+// message and the client headers that the forwarded request is built from.
+type clientQuerySample struct {
+	size   int
+	header http.Header
+}
+
+// clientQuerySamples remembers the shape of the most recently relayed
+// queries, so that cover queries follow the same distribution.
+type clientQuerySamples struct {
+	sync.Mutex
+	headerNames []string
+	samples     []clientQuerySample
+	next        int
+}
+
+func newClientQuerySamples(headers *headerPolicy) *clientQuerySamples {
+	return &clientQuerySamples{
+		headerNames: append(append([]string(nil), headers.forwardedRequestHeaders...), "Via"),
+	}
+}
+
+// record remembers a relayed query of size bytes sent with clientHeader.
+// Only the headers that reach the target are kept.
+func (s *clientQuerySamples) record(size int, clientHeader http.Header) {
+	if s == nil {
+		return
+	}
+	header := make(http.Header)
+	for _, name := range s.headerNames {
+		if values, ok := clientHeader[name]; ok {
+			header[name] = append([]string(nil), values...)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	sample := clientQuerySample{size: size, header: header}
+	if len(s.samples) < maxClientQuerySamples {
+		s.samples = append(s.samples, sample)
+		return
+	}
+	s.samples[s.next] = sample
+	s.next = (s.next + 1) % maxClientQuerySamples
+}
+
+// sample returns one of the remembered queries at random.
+func (s *clientQuerySamples) sample() (clientQuerySample, bool) {
+	if s == nil {
+		return clientQuerySample{}, false
+	}
+	s.Lock()
+	defer s.Unlock()
+	if len(s.samples) == 0 {
+		return clientQuerySample{}, false
+	}
+	return s.samples[randomUint64()%uint64(len(s.samples))], true
+}
+
+// coverRequestKey marks the context of a dummy query, so that per-target
+// statistics count only relayed queries.
+type coverRequestKey struct{}
+
+func withCoverRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, coverRequestKey{}, true)
+}
+
+func isCoverRequest(ctx context.Context) bool {
+	cover, _ := ctx.Value(coverRequestKey{}).(bool)
+	return cover
+}
+
+// nextInterval returns the time until the next dummy query. Intervals are
+// exponentially distributed, so dummy queries form a Poisson process like
+// independent client queries do.
+func (g *coverTrafficGenerator) nextInterval() time.Duration {
+	uniform := (float64(randomUint64()>>11) + 1) / (1 << 53)
+	return time.Duration(-math.Log(uniform) / g.rate * float64(time.Second))
+}
+
+// run sends dummy queries to every target until ctx is done.
+func (g *coverTrafficGenerator) run(ctx context.Context) {
+	for _, target := range g.targets {
+		go g.runTarget(ctx, target)
+	}
+}
+
+func (g *coverTrafficGenerator) runTarget(ctx context.Context, targetName string) {
+	timer := time.NewTimer(g.nextInterval())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		go func() {
+			if err := g.sendCoverQuery(ctx, targetName); err != nil {
+				log.Printf("Failed sending cover query to %s: %v", targetName, err)
+				g.metrics.increment("proxy_cover_queries_failed")
+				return
+			}
+			g.metrics.increment("proxy_cover_queries_sent")
+		}()
+		timer.Reset(g.nextInterval())
+	}
+}
+
+// createCoverQuery builds a recursive query for one of the cover names.
+func (g *coverTrafficGenerator) createCoverQuery() ([]byte, error) {
+	name := g.names[randomUint64()%uint64(len(g.names))]
+	queryTypes := []uint16{dns.TypeA, dns.TypeAAAA}
+
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), queryTypes[randomUint64()%uint64(len(queryTypes))])
+	query.Id = 0
+	return query.Pack()
+}
+
+// sealCoverQuery seals packedQuery for config, padded so that the sealed
+// message is size bytes long, or to a multiple of coverPaddingBlockSize if
+// size is zero or too small.
+func sealCoverQuery(packedQuery []byte, config odoh.ObliviousDoHConfigContents, size int) ([]byte, error) {
+	padding := (coverPaddingBlockSize - len(packedQuery)%coverPaddingBlockSize) % coverPaddingBlockSize
+	if size > 0 {
+		unpadded, _, err := config.EncryptQuery(odoh.CreateObliviousDNSQuery(packedQuery, 0))
+		if err != nil {
+			return nil, err
+		}
+		if sizePadding := size - len(unpadded.Marshal()); sizePadding >= 0 && sizePadding <= math.MaxUint16 {
+			padding = sizePadding
+		}
+	}
+
+	sealed, _, err := config.EncryptQuery(odoh.CreateObliviousDNSQuery(packedQuery, uint16(padding)))
+	if err != nil {
+		return nil, err
+	}
+	return sealed.Marshal(), nil
+}
+
+func (g *coverTrafficGenerator) sendCoverQuery(ctx context.Context, targetName string) error {
+	ctx = withCoverRequest(ctx)
+	if g.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.timeout)
+		defer cancel()
+	}
+
+	configs, err := g.configs.get(ctx, targetName)
+	if err != nil {
+		return err
+	}
+	packedQuery, err := g.createCoverQuery()
+	if err != nil {
+		return err
+	}
+	sample, _ := g.samples.sample()
+	message, err := sealCoverQuery(packedQuery, configs.Configs[0].Contents, sample.size)
+	if err != nil {
+		return err
+	}
+
+	targetURL, err := forwardingURL(g.nextHop, targetName, g.targetPath)
+	if err != nil {
+		return err
+	}
+	header := forwardedRequestHeader(g.headers, g.nextHop, sample.header)
+
+	response, err := forwardProxyRequest(ctx, g.client, targetURL, bytes.NewReader(message), int64(len(message)), header)
+	if err != nil {
+		return err
+	}
+	defer response.body.Close()
+	if _, err := copyLimitedBody(ioutil.Discard, response.body, maxObliviousMessageSize); err != nil {
+		return err
+	}
+	if response.statusCode != http.StatusOK {
+		return fmt.Errorf("target answered with status %d", response.statusCode)
+	}
+	return nil
+}
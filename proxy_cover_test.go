@@ -0,0 +1,128 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"github.com/chris-wood/odoh"
+	"github.com/miekg/dns"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestSealCoverQueryPadding(t *testing.T) {
+	keyPair, err := odoh.CreateKeyPairFromSeed(kemID, kdfID, aeadID, make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	packedQuery, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		size       int
+		sealedSize int
+	}{
+		{name: "block padding without a relayed query"},
+		{name: "size of a relayed query", size: 300, sealedSize: 300},
+		{name: "block padding below the unpadded size", size: 10},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sealed, err := sealCoverQuery(packedQuery, keyPair.Config.Contents, test.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.sealedSize != 0 && len(sealed) != test.sealedSize {
+				t.Errorf("sealed %d bytes, want %d", len(sealed), test.sealedSize)
+			}
+
+			message, err := odoh.UnmarshalDNSMessage(sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opened, _, err := keyPair.DecryptQuery(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(opened.DnsMessage, packedQuery) {
+				t.Errorf("opened query %x, want %x", opened.DnsMessage, packedQuery)
+			}
+			if test.sealedSize == 0 && (len(opened.DnsMessage)+len(opened.Padding))%coverPaddingBlockSize != 0 {
+				t.Errorf("%d bytes of query and %d bytes of padding, want a multiple of %d", len(opened.DnsMessage), len(opened.Padding), coverPaddingBlockSize)
+			}
+		})
+	}
+}
+
+func TestCoverQueryHeadersFollowRelayedQueries(t *testing.T) {
+	policy, err := newHeaderPolicy([]string{"X-Request-Priority"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextHop, err := newNextHopProxy("https://next.example.net/dns-proxy{?targethost,targetpath}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientHeader := http.Header{
+		"Content-Type":       {obliviousDNSMessageContentType},
+		"Cookie":             {"session=1"},
+		"X-Request-Priority": {"high"},
+		"Via":                {"1.1 odoh-previous"},
+	}
+
+	samples := newClientQuerySamples(policy)
+	samples.record(200, clientHeader)
+	sample, ok := samples.sample()
+	if !ok {
+		t.Fatal("no relayed query sampled")
+	}
+	if sample.size != 200 {
+		t.Errorf("sampled size %d, want 200", sample.size)
+	}
+	if _, ok := sample.header["Cookie"]; ok {
+		t.Errorf("sampled headers %v keep a header never forwarded", sample.header)
+	}
+
+	relayed := forwardedRequestHeader(policy, nextHop, clientHeader)
+	cover := forwardedRequestHeader(policy, nextHop, sample.header)
+	if !reflect.DeepEqual(cover, relayed) {
+		t.Errorf("cover query headers %v, want those of the relayed query %v", cover, relayed)
+	}
+
+	for index := 0; index < maxClientQuerySamples; index++ {
+		samples.record(1000+index, clientHeader)
+	}
+	if len(samples.samples) != maxClientQuerySamples {
+		t.Errorf("%d relayed queries remembered, want %d", len(samples.samples), maxClientQuerySamples)
+	}
+	for _, sample := range samples.samples {
+		if sample.size == 200 {
+			t.Error("oldest relayed query still remembered")
+		}
+	}
+}
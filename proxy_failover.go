@@ -0,0 +1,105 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// targetDialer connects the proxy to targets. When connecting to one
+// address of a target, or the TLS handshake with it, fails, it fails over
+// to the target's other addresses after a short random backoff. Nothing of
+// the request has been sent at that point, so the retry is always safe.
+// Retries are bounded per connection and by a budget shared by all targets,
+// so that an outage does not multiply the load on the remaining replicas.
+type targetDialer struct {
+	resolve     func(context.Context, string) ([]net.IP, error)
+	dialer      *net.Dialer
+	tls         *pinnedTLSClient
+	maxAttempts int
+	budget      *tokenBucket
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	metrics     *metrics
+}
+
+// isRetryableDialError reports whether another address may be tried after
+// err. Pin mismatches are not retried: they point at an attack rather than
+// at a failed replica.
+func isRetryableDialError(err error) bool {
+	return !errors.Is(err, errPinMismatch) && !errors.Is(err, errPrivateTarget)
+}
+
+// DialTLSContext returns a TLS connection to the target at address.
+func (d *targetDialer) DialTLSContext(ctx context.Context, network string, address string) (*tls.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start at a random address so that connections spread over replicas
+	start := int(randomUint64() % uint64(len(addresses)))
+	attempts := d.maxAttempts
+	if attempts > len(addresses) {
+		attempts = len(addresses)
+	}
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if d.budget != nil && !d.budget.allow() {
+				d.metrics.increment("proxy_retry_budget_exhausted")
+				break
+			}
+			d.metrics.increment("proxy_target_retries")
+			select {
+			case <-time.After(randomDuration(d.minBackoff, d.maxBackoff)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		ip := addresses[(start+attempt)%len(addresses)]
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			var tlsConn *tls.Conn
+			if tlsConn, err = d.tls.handshake(ctx, conn, host); err == nil {
+				return tlsConn, nil
+			}
+		}
+		lastErr = err
+		if ctx.Err() != nil || !isRetryableDialError(err) {
+			break
+		}
+		log.Printf("Failed connecting to %s at %v: %v", host, ip, err)
+	}
+	return nil, lastErr
+}
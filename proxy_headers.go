@@ -0,0 +1,127 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	obliviousDNSMessageContentType = "application/oblivious-dns-message"
+
+	// Every proxy presents the same User-Agent so that the target cannot
+	// tell clients apart by their HTTP stack.
+	proxyUserAgent = "odoh-proxy"
+)
+
+var (
+	// Target response headers relayed to the client. Every other header is
+	// dropped so that the target cannot pass information to the client, or
+	// learn about it, outside the encrypted response.
+	forwardedResponseHeaders = []string{"Content-Type", "Cache-Control", "Retry-After"}
+
+	// Headers that identify the client or its path to the proxy. They are
+	// never sent to the target, even if an operator allowlists them.
+	identifyingRequestHeaders = []string{
+		"Authorization", "Cookie", "Forwarded", "Proxy-Authorization",
+		"True-Client-IP", "User-Agent", "Via", "X-Forwarded-For",
+		"X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-IP",
+	}
+)
+
+// headerPolicy decides which headers cross the proxy in each direction.
+type headerPolicy struct {
+	forwardedRequestHeaders []string
+}
+
+func isIdentifyingRequestHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, identifying := range identifyingRequestHeaders {
+		if name == identifying {
+			return true
+		}
+	}
+	return false
+}
+
+// newHeaderPolicy builds a policy that forwards the client request headers
+// in allowlist, in addition to the headers the proxy always sets.
+func newHeaderPolicy(allowlist []string) (*headerPolicy, error) {
+	policy := &headerPolicy{}
+	for _, name := range allowlist {
+		if isIdentifyingRequestHeader(name) {
+			return nil, fmt.Errorf("header %s identifies the client and cannot be forwarded", name)
+		}
+		policy.forwardedRequestHeaders = append(policy.forwardedRequestHeaders, http.CanonicalHeaderKey(name))
+	}
+	return policy, nil
+}
+
+func hasObliviousContentType(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && strings.EqualFold(mediaType, obliviousDNSMessageContentType)
+}
+
+// checkClientRequest rejects client requests that do not carry an
+// oblivious DNS message.
+func (p *headerPolicy) checkClientRequest(header http.Header) error {
+	if !hasObliviousContentType(header) {
+		return fmt.Errorf("incorrect content type, expected '%s', got %s", obliviousDNSMessageContentType, header.Get("Content-Type"))
+	}
+	return nil
+}
+
+// targetRequestHeaders returns the headers sent to the target for a client
+// request with the given headers.
+func (p *headerPolicy) targetRequestHeaders(clientHeader http.Header) http.Header {
+	header := make(http.Header)
+	for _, name := range p.forwardedRequestHeaders {
+		if values, ok := clientHeader[name]; ok {
+			header[name] = append([]string(nil), values...)
+		}
+	}
+	header.Set("Content-Type", obliviousDNSMessageContentType)
+	header.Set("Accept", obliviousDNSMessageContentType)
+	header.Set("User-Agent", proxyUserAgent)
+	return header
+}
+
+// clientResponseHeaders returns the headers relayed to the client for a
+// target response with the given status and headers. Successful responses
+// must carry an oblivious DNS message.
+func (p *headerPolicy) clientResponseHeaders(statusCode int, targetHeader http.Header) (http.Header, error) {
+	if statusCode == http.StatusOK && !hasObliviousContentType(targetHeader) {
+		return nil, fmt.Errorf("target answered with content type %s", targetHeader.Get("Content-Type"))
+	}
+
+	header := make(http.Header)
+	for _, name := range forwardedResponseHeaders {
+		if value := targetHeader.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	return header, nil
+}
@@ -0,0 +1,175 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNewHeaderPolicy(t *testing.T) {
+	for _, test := range []struct {
+		allowlist []string
+		valid     bool
+	}{
+		{allowlist: nil, valid: true},
+		{allowlist: []string{"x-request-priority", "Accept-Language"}, valid: true},
+		{allowlist: []string{"x-forwarded-for"}},
+		{allowlist: []string{"Accept-Language", "COOKIE"}},
+		{allowlist: []string{"user-agent"}},
+		{allowlist: []string{"Authorization"}},
+	} {
+		_, err := newHeaderPolicy(test.allowlist)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("allowlist %v: error %v", test.allowlist, err)
+		}
+	}
+}
+
+func TestTargetRequestHeaders(t *testing.T) {
+	policy, err := newHeaderPolicy([]string{"X-Request-Priority"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientHeader := http.Header{
+		"Content-Type":       {"application/oblivious-dns-message; charset=binary"},
+		"Accept":             {"*/*"},
+		"User-Agent":         {"client/1.0"},
+		"Authorization":      {"PrivateToken token=abc"},
+		"Cookie":             {"session=1"},
+		"X-Forwarded-For":    {"192.0.2.1"},
+		"Forwarded":          {"for=192.0.2.1"},
+		"X-Request-Priority": {"high", "low"},
+		"Accept-Language":    {"en"},
+	}
+	header := policy.targetRequestHeaders(clientHeader)
+
+	for _, test := range []struct {
+		class  string
+		name   string
+		values []string
+	}{
+		{class: "set by the proxy", name: "Content-Type", values: []string{obliviousDNSMessageContentType}},
+		{class: "set by the proxy", name: "Accept", values: []string{obliviousDNSMessageContentType}},
+		{class: "set by the proxy", name: "User-Agent", values: []string{proxyUserAgent}},
+		{class: "identifying", name: "Authorization"},
+		{class: "identifying", name: "Cookie"},
+		{class: "identifying", name: "X-Forwarded-For"},
+		{class: "identifying", name: "Forwarded"},
+		{class: "allowlisted", name: "X-Request-Priority", values: []string{"high", "low"}},
+		{class: "not allowlisted", name: "Accept-Language"},
+	} {
+		if values := header[test.name]; !equalStrings(values, test.values) {
+			t.Errorf("%s header %s: sent %q, want %q", test.class, test.name, values, test.values)
+		}
+	}
+	if len(header) != 4 {
+		t.Errorf("sent headers %v, want only the proxy and allowlisted headers", header)
+	}
+}
+
+func TestClientResponseHeaders(t *testing.T) {
+	policy, err := newHeaderPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetHeader := http.Header{
+		"Content-Type":  {obliviousDNSMessageContentType},
+		"Cache-Control": {"max-age=300"},
+		"Retry-After":   {"10"},
+		"Set-Cookie":    {"tracking=1"},
+		"Server":        {"target/1.0"},
+		"Date":          {"Mon, 19 Oct 2026 00:00:00 GMT"},
+	}
+	header, err := policy.clientResponseHeaders(http.StatusOK, targetHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		forwarded bool
+	}{
+		{name: "Content-Type", forwarded: true},
+		{name: "Cache-Control", forwarded: true},
+		{name: "Retry-After", forwarded: true},
+		{name: "Set-Cookie"},
+		{name: "Server"},
+		{name: "Date"},
+	} {
+		if forwarded := header.Get(test.name) != ""; forwarded != test.forwarded {
+			t.Errorf("response header %s: forwarded %v, want %v", test.name, forwarded, test.forwarded)
+		}
+	}
+
+	for _, test := range []struct {
+		status      int
+		contentType string
+		valid       bool
+	}{
+		{status: http.StatusOK, contentType: obliviousDNSMessageContentType, valid: true},
+		{status: http.StatusOK, contentType: "Application/Oblivious-DNS-Message; q=1", valid: true},
+		{status: http.StatusOK, contentType: "text/html"},
+		{status: http.StatusOK},
+		{status: http.StatusBadGateway, contentType: "text/plain", valid: true},
+		{status: http.StatusTooManyRequests, valid: true},
+	} {
+		_, err := policy.clientResponseHeaders(test.status, http.Header{"Content-Type": {test.contentType}})
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("status %d with content type %q: error %v", test.status, test.contentType, err)
+		}
+	}
+}
+
+func TestCheckClientRequest(t *testing.T) {
+	policy, err := newHeaderPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		contentType string
+		valid       bool
+	}{
+		{contentType: obliviousDNSMessageContentType, valid: true},
+		{contentType: "application/oblivious-dns-message; charset=binary", valid: true},
+		{contentType: "application/dns-message"},
+		{contentType: ""},
+	} {
+		err := policy.checkClientRequest(http.Header{"Content-Type": {test.contentType}})
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("content type %q: error %v", test.contentType, err)
+		}
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
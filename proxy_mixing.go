@@ -0,0 +1,185 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	// Each request is held for an independent random delay
+	mixingModeDelay = "delay"
+	// Requests are pooled and released one at a time in a random order
+	mixingModeBatch = "batch"
+)
+
+// requestMixer holds proxied requests back before they are forwarded, so
+// that an observer of the proxy's ingress and egress cannot match requests
+// by timing. No request is ever held for longer than maxDelay.
+type requestMixer struct {
+	sync.Mutex
+	mode      string
+	minDelay  time.Duration
+	maxDelay  time.Duration
+	batchSize int
+	metrics   *metrics
+
+	pool  []*pooledRequest
+	timer *time.Timer
+	// Counts released batches, so that a timer that fired while its batch
+	// was being released cannot release the next one
+	generation uint64
+}
+
+// pooledRequest is a request waiting for its batch to be released.
+type pooledRequest struct {
+	// Closed when the request may be forwarded
+	release chan struct{}
+	// Closed once the request resumed, or gave up waiting
+	resumed chan struct{}
+}
+
+func newRequestMixer(mode string, minDelay time.Duration, maxDelay time.Duration, batchSize int, metrics *metrics) *requestMixer {
+	return &requestMixer{
+		mode:      mode,
+		minDelay:  minDelay,
+		maxDelay:  maxDelay,
+		batchSize: batchSize,
+		metrics:   metrics,
+	}
+}
+
+// randomUint64 returns a uniformly random value from a cryptographic source,
+// since predictable delays would defeat their purpose.
+func randomUint64() uint64 {
+	var buffer [8]byte
+	if _, err := rand.Read(buffer[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint64(buffer[:])
+}
+
+// randomDuration returns a uniformly random duration in [min, max].
+func randomDuration(min time.Duration, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(randomUint64()%uint64(max-min+1))
+}
+
+// wait blocks until the request may be forwarded, or ctx is done.
+func (m *requestMixer) wait(ctx context.Context) error {
+	start := time.Now()
+	var err error
+	if m.mode == mixingModeBatch {
+		err = m.waitForBatch(ctx)
+	} else {
+		err = m.waitForDelay(ctx)
+	}
+	m.metrics.observe("proxy_mixing_delay", time.Since(start))
+	return err
+}
+
+func (m *requestMixer) waitForDelay(ctx context.Context) error {
+	timer := time.NewTimer(randomDuration(m.minDelay, m.maxDelay))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *requestMixer) waitForBatch(ctx context.Context) error {
+	request := &pooledRequest{
+		release: make(chan struct{}),
+		resumed: make(chan struct{}),
+	}
+	defer close(request.resumed)
+
+	m.Lock()
+	m.pool = append(m.pool, request)
+	if len(m.pool) >= m.batchSize {
+		m.releaseLocked()
+	} else if m.timer == nil {
+		// The first request of a batch bounds how long the batch can wait.
+		generation := m.generation
+		m.timer = time.AfterFunc(m.maxDelay, func() { m.release(generation) })
+	}
+	m.Unlock()
+
+	select {
+	case <-request.release:
+		return nil
+	case <-ctx.Done():
+		// The request stays in the pool, and is released with it, so that
+		// cancellations do not change the size of the batch.
+		return ctx.Err()
+	}
+}
+
+// release releases the batch with the given generation, unless it has
+// already been released.
+func (m *requestMixer) release(generation uint64) {
+	m.Lock()
+	defer m.Unlock()
+	if m.generation == generation {
+		m.releaseLocked()
+	}
+}
+
+// releaseLocked releases the pooled requests one at a time, in a random
+// order: each request is released once the previous one resumed, so that
+// they leave the proxy in that order rather than in the order the scheduler
+// happens to wake them up. It must be called with the lock held.
+func (m *requestMixer) releaseLocked() {
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	if len(m.pool) == 0 {
+		return
+	}
+
+	m.generation++
+	pool := m.pool
+	m.pool = nil
+	for index := len(pool) - 1; index > 0; index-- {
+		other := int(randomUint64() % uint64(index+1))
+		pool[index], pool[other] = pool[other], pool[index]
+	}
+	go func() {
+		for _, request := range pool {
+			close(request.release)
+			<-request.resumed
+		}
+	}()
+	m.metrics.increment("proxy_mixing_batches")
+	m.metrics.add("proxy_mixing_batched_requests", uint64(len(pool)))
+}
@@ -0,0 +1,134 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runBatch pools batchSize requests, in order, the first one with ctx, and
+// returns the order in which the others resumed.
+func runBatch(ctx context.Context, batchSize int) []int {
+	mixer := newRequestMixer(mixingModeBatch, 0, time.Minute, batchSize, nil)
+	var lock sync.Mutex
+	var order []int
+	var done sync.WaitGroup
+	for index := 0; index < batchSize; index++ {
+		requestCtx := context.Background()
+		if index == 0 {
+			requestCtx = ctx
+		}
+		done.Add(1)
+		go func(index int) {
+			defer done.Done()
+			if err := mixer.wait(requestCtx); err == nil {
+				lock.Lock()
+				order = append(order, index)
+				lock.Unlock()
+			}
+		}(index)
+		// Pool the requests in the order of their index
+		for pooled := false; !pooled; {
+			mixer.Lock()
+			pooled = len(mixer.pool) > index || len(mixer.pool) == 0 && index == batchSize-1
+			mixer.Unlock()
+		}
+	}
+	done.Wait()
+	return order
+}
+
+func TestBatchMixingReleasesInRandomOrder(t *testing.T) {
+	const batchSize = 8
+	shuffled := false
+	for trial := 0; trial < 5 && !shuffled; trial++ {
+		order := runBatch(context.Background(), batchSize)
+		if len(order) != batchSize {
+			t.Fatalf("%d requests released, want %d", len(order), batchSize)
+		}
+		for index, request := range order {
+			if request != index {
+				shuffled = true
+			}
+		}
+	}
+	if !shuffled {
+		t.Error("requests always released in the order they arrived")
+	}
+}
+
+func TestBatchMixingReleasesAfterCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if order := runBatch(ctx, 4); len(order) != 3 {
+		t.Errorf("%d requests released around a canceled one, want 3", len(order))
+	}
+}
+
+func TestBatchMixingIgnoresStaleTimer(t *testing.T) {
+	mixer := newRequestMixer(mixingModeBatch, 0, time.Minute, 2, nil)
+	pooled := func(count int) {
+		for {
+			mixer.Lock()
+			length := len(mixer.pool)
+			mixer.Unlock()
+			if length == count {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// A full batch is released while its timer callback waits for the lock.
+	first := make(chan error, 2)
+	go func() { first <- mixer.wait(context.Background()) }()
+	pooled(1)
+	staleGeneration := mixer.generation
+	go func() { first <- mixer.wait(context.Background()) }()
+	for index := 0; index < 2; index++ {
+		if err := <-first; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	next := make(chan error, 1)
+	go func() { next <- mixer.wait(context.Background()) }()
+	pooled(1)
+	mixer.release(staleGeneration)
+	select {
+	case <-next:
+		t.Fatal("stale timer released the next batch before it was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mixer.Lock()
+	generation := mixer.generation
+	mixer.Unlock()
+	mixer.release(generation)
+	if err := <-next; err != nil {
+		t.Fatal(err)
+	}
+}
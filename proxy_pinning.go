@@ -0,0 +1,155 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const spkiPinPrefix = "sha256/"
+
+var errPinMismatch = errors.New("target certificate chain matches none of its pins")
+
+// parseSPKIPin decodes a pin of the form sha256/<base64 SPKI digest>.
+func parseSPKIPin(pin string) ([sha256.Size]byte, error) {
+	var digest [sha256.Size]byte
+	if !strings.HasPrefix(pin, spkiPinPrefix) {
+		return digest, fmt.Errorf("pin %q must start with %s", pin, spkiPinPrefix)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, spkiPinPrefix))
+	if err != nil || len(decoded) != sha256.Size {
+		return digest, fmt.Errorf("pin %q is not a base64 SHA-256 digest", pin)
+	}
+	copy(digest[:], decoded)
+	return digest, nil
+}
+
+// pinnedTLSClient secures the connections of the proxy to targets with TLS
+// and checks them against per-target SPKI pins, so that a certificate issued
+// by a compromised CA cannot impersonate a pinned target.
+type pinnedTLSClient struct {
+	config           *tls.Config
+	handshakeTimeout time.Duration
+	pins             map[string]map[[sha256.Size]byte]bool
+	reportOnly       bool
+	metrics          *metrics
+}
+
+func newPinnedTLSClient(config *tls.Config, handshakeTimeout time.Duration, pins map[string][]string, reportOnly bool, metrics *metrics) (*pinnedTLSClient, error) {
+	pinned := &pinnedTLSClient{
+		config:           config,
+		handshakeTimeout: handshakeTimeout,
+		pins:             make(map[string]map[[sha256.Size]byte]bool),
+		reportOnly:       reportOnly,
+		metrics:          metrics,
+	}
+	for host, hostPins := range pins {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if pinned.pins[host] == nil {
+			pinned.pins[host] = make(map[[sha256.Size]byte]bool)
+		}
+		for _, pin := range hostPins {
+			digest, err := parseSPKIPin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pinned.pins[host][digest] = true
+		}
+	}
+	return pinned, nil
+}
+
+// checkPins returns errPinMismatch unless some certificate of a verified
+// chain has a pinned public key. Hosts without pins are not checked.
+func (d *pinnedTLSClient) checkPins(host string, state tls.ConnectionState) error {
+	hostPins, ok := d.pins[strings.ToLower(strings.TrimSuffix(host, "."))]
+	if !ok {
+		return nil
+	}
+	for _, chain := range state.VerifiedChains {
+		for _, certificate := range chain {
+			if hostPins[sha256.Sum256(certificate.RawSubjectPublicKeyInfo)] {
+				return nil
+			}
+		}
+	}
+	return errPinMismatch
+}
+
+// handshake completes the TLS handshake with host over conn, within the
+// handshake timeout, and checks its pins. conn is closed on failure.
+func (d *pinnedTLSClient) handshake(ctx context.Context, conn net.Conn, host string) (*tls.Conn, error) {
+	config := d.config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+
+	if d.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.handshakeTimeout)
+		defer cancel()
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	handshakeDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+	err := tlsConn.Handshake()
+	close(handshakeDone)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("TLS handshake with %s: %w", host, ctx.Err())
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if err := d.checkPins(host, tlsConn.ConnectionState()); err != nil {
+		d.metrics.increment("proxy_pin_failures")
+		if d.reportOnly {
+			log.Printf("Pin check failed for %s (report only): %v", host, err)
+		} else {
+			log.Printf("Pin check failed for %s: %v", host, err)
+			tlsConn.Close()
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,190 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+var (
+	// Networks a proxy must not be tricked into connecting to (RFC 6890)
+	privateNetworks = mustParseCIDRs(
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16",
+		"198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+		// NAT64, local-use NAT64 (RFC 8215), IPv4-compatible, 6to4 and
+		// Teredo addresses embed an IPv4 address, which may itself be
+		// private
+		"64:ff9b::/96", "64:ff9b:1::/48", "::/96", "2002::/16", "2001::/32",
+	)
+
+	errTargetNotAllowed = errors.New("target host is not in the allowlist")
+	errPrivateTarget    = errors.New("target host resolves to a private address")
+	errUnknownTarget    = errors.New("target host does not publish a valid ODoH configuration")
+	errUnresolvedTarget = errors.New("failed resolving target host")
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for index, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[index] = network
+	}
+	return networks
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	return containsIP(privateNetworks, ip)
+}
+
+// targetHostname strips an optional port from a targethost value.
+func targetHostname(targetHost string) string {
+	if host, _, err := net.SplitHostPort(targetHost); err == nil {
+		return host
+	}
+	return strings.Trim(targetHost, "[]")
+}
+
+// targetPolicy decides which targets the proxy is willing to forward to.
+type targetPolicy struct {
+	allowedHosts    []string
+	allowedSuffixes []string
+	allowAny        bool
+	allowPrivate    bool
+	resolver        *hostResolver
+	configs         *targetConfigCache
+}
+
+// newTargetPolicy builds a policy from allowlist entries. Entries starting
+// with a dot, such as ".example.net", allow every name below that domain;
+// other entries allow exactly that name. An empty allowlist allows no name,
+// unless allowAny is set.
+func newTargetPolicy(allowlist []string, allowAny bool, allowPrivate bool, resolver *hostResolver) *targetPolicy {
+	policy := &targetPolicy{
+		allowAny:     allowAny,
+		allowPrivate: allowPrivate,
+		resolver:     resolver,
+	}
+	for _, entry := range allowlist {
+		entry = strings.ToLower(strings.TrimSuffix(entry, "."))
+		if strings.HasPrefix(entry, ".") {
+			policy.allowedSuffixes = append(policy.allowedSuffixes, entry)
+		} else {
+			policy.allowedHosts = append(policy.allowedHosts, entry)
+		}
+	}
+	return policy
+}
+
+func (p *targetPolicy) isAllowedName(hostname string) bool {
+	if len(p.allowedHosts) == 0 && len(p.allowedSuffixes) == 0 {
+		return p.allowAny
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	for _, host := range p.allowedHosts {
+		if hostname == host {
+			return true
+		}
+	}
+	for _, suffix := range p.allowedSuffixes {
+		if strings.HasSuffix(hostname, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTargetName returns errTargetNotAllowed unless the allowlist allows
+// targetHost.
+func (p *targetPolicy) checkTargetName(_ context.Context, targetHost string) error {
+	if !p.isAllowedName(targetHostname(targetHost)) {
+		return errTargetNotAllowed
+	}
+	return nil
+}
+
+// checkTarget returns an error describing why the proxy must not forward
+// to targetHost, or nil if it may.
+func (p *targetPolicy) checkTarget(ctx context.Context, targetHost string) error {
+	if err := p.checkTargetName(ctx, targetHost); err != nil {
+		return err
+	}
+	if _, err := p.resolveTarget(ctx, targetHostname(targetHost)); err != nil {
+		return err
+	}
+
+	if p.configs != nil {
+		return p.configs.checkTarget(ctx, targetHost)
+	}
+	return nil
+}
+
+// resolveTarget returns the addresses the proxy may connect to for
+// hostname, refusing hosts with any private address.
+func (p *targetPolicy) resolveTarget(ctx context.Context, hostname string) ([]net.IP, error) {
+	addresses := []net.IP{net.ParseIP(hostname)}
+	if addresses[0] == nil {
+		var err error
+		addresses, err = p.resolver.lookup(ctx, hostname)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errUnresolvedTarget, err)
+		}
+	}
+	if !p.allowPrivate {
+		for _, address := range addresses {
+			if isPrivateIP(address) {
+				return nil, errPrivateTarget
+			}
+		}
+	}
+	return addresses, nil
+}
+
+// dialControl refuses connections to private addresses. It is installed on
+// the proxy's dialer so that a target cannot pass checkTarget and then
+// resolve to a private address when the connection is made.
+func (p *targetPolicy) dialControl(network, address string, _ syscall.RawConn) error {
+	if p.allowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && isPrivateIP(ip) {
+		return errPrivateTarget
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	for _, test := range []struct {
+		address string
+		private bool
+	}{
+		{address: "192.0.2.1"},
+		{address: "2001:db8::1"},
+		{address: "10.1.2.3", private: true},
+		{address: "127.0.0.1", private: true},
+		{address: "::ffff:127.0.0.1", private: true},
+		{address: "::1", private: true},
+		{address: "fe80::1", private: true},
+		// NAT64, local-use NAT64, IPv4-compatible, 6to4 and Teredo addresses
+		{address: "64:ff9b::7f00:1", private: true},
+		{address: "64:ff9b::c000:201", private: true},
+		{address: "64:ff9b:1::a00:1", private: true},
+		{address: "64:ff9b:1:ffff::c0a8:1", private: true},
+		{address: "::127.0.0.1", private: true},
+		{address: "::10.0.0.1", private: true},
+		{address: "2002:7f00:1::1", private: true},
+		{address: "2002:c0a8:101::1", private: true},
+		{address: "2001:0:4136:e378:8000:63bf:80ff:fffe", private: true},
+		{address: "2001:0:a00:1::1", private: true},
+		{address: "2001:4860::8888"},
+	} {
+		if private := isPrivateIP(net.ParseIP(test.address)); private != test.private {
+			t.Errorf("isPrivateIP(%s) = %v, want %v", test.address, private, test.private)
+		}
+	}
+}
+
+func TestCheckTargetName(t *testing.T) {
+	for _, test := range []struct {
+		allowlist []string
+		allowAny  bool
+		target    string
+		allowed   bool
+	}{
+		{target: "odoh.example.net"},
+		{allowAny: true, target: "odoh.example.net", allowed: true},
+		{allowlist: []string{"odoh.example.net"}, target: "odoh.example.net:443", allowed: true},
+		{allowlist: []string{"odoh.example.net"}, target: "ODOH.example.net.", allowed: true},
+		{allowlist: []string{"odoh.example.net"}, target: "other.example.net"},
+		{allowlist: []string{".example.net"}, target: "odoh.example.net", allowed: true},
+		{allowlist: []string{".example.net"}, target: "example.org"},
+	} {
+		policy := newTargetPolicy(test.allowlist, test.allowAny, false, nil)
+		err := policy.checkTargetName(context.Background(), test.target)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("allowlist %v, allow any %v: target %s allowed %v, want %v", test.allowlist, test.allowAny, test.target, allowed, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long addresses from the system resolver, which does not report
+	// TTLs, are cached
+	defaultHostCacheTTL = time.Minute
+
+	// Most target hosts whose addresses are cached at once
+	maxCachedHosts = 10000
+)
+
+var errNoAddresses = errors.New("no addresses found")
+
+type cachedHost struct {
+	addresses []net.IP
+	expires   time.Time
+}
+
+// hostResolver resolves target host names for the proxy, so that they are
+// neither sent to nor manipulated through the local system resolver. Names
+// are answered from a static map, then from a cache honouring record TTLs,
+// and finally by the configured name servers.
+type hostResolver struct {
+	sync.Mutex
+	nameServers []string
+	staticHosts map[string][]net.IP
+	client      *dns.Client
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	cache       map[string]cachedHost
+	metrics     *metrics
+}
+
+func newHostResolver(nameServers []string, staticHosts map[string][]string, timeout time.Duration, minTTL time.Duration, maxTTL time.Duration, metrics *metrics) (*hostResolver, error) {
+	resolver := &hostResolver{
+		nameServers: nameServers,
+		staticHosts: make(map[string][]net.IP),
+		client:      &dns.Client{Timeout: timeout},
+		minTTL:      minTTL,
+		maxTTL:      maxTTL,
+		cache:       make(map[string]cachedHost),
+		metrics:     metrics,
+	}
+	for host, addresses := range staticHosts {
+		host = normalizeHostname(host)
+		for _, address := range addresses {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("static address %q of %s is not an IP address", address, host)
+			}
+			resolver.staticHosts[host] = append(resolver.staticHosts[host], ip)
+		}
+	}
+	return resolver, nil
+}
+
+func normalizeHostname(hostname string) string {
+	return strings.ToLower(strings.TrimSuffix(hostname, "."))
+}
+
+// lookup returns the addresses of hostname.
+func (r *hostResolver) lookup(ctx context.Context, hostname string) ([]net.IP, error) {
+	hostname = normalizeHostname(hostname)
+	if addresses, ok := r.staticHosts[hostname]; ok {
+		return addresses, nil
+	}
+
+	r.Lock()
+	entry, ok := r.cache[hostname]
+	r.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		r.metrics.increment("proxy_host_cache_hits")
+		return entry.addresses, nil
+	}
+	r.metrics.increment("proxy_host_cache_misses")
+
+	var addresses []net.IP
+	var ttl time.Duration
+	var err error
+	if len(r.nameServers) == 0 {
+		addresses, err = lookupSystemHost(ctx, hostname)
+		ttl = defaultHostCacheTTL
+	} else {
+		addresses, ttl, err = r.lookupNameServers(ctx, hostname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ttl < r.minTTL {
+		ttl = r.minTTL
+	}
+	if r.maxTTL > 0 && ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+
+	r.Lock()
+	if len(r.cache) >= maxCachedHosts {
+		r.evictLocked()
+	}
+	r.cache[hostname] = cachedHost{addresses: addresses, expires: time.Now().Add(ttl)}
+	r.Unlock()
+	return addresses, nil
+}
+
+// evictLocked makes room for a new entry, dropping expired entries or, if
+// there are none, an arbitrary one.
+func (r *hostResolver) evictLocked() {
+	now := time.Now()
+	for host, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			delete(r.cache, host)
+		}
+	}
+	for host := range r.cache {
+		if len(r.cache) < maxCachedHosts {
+			break
+		}
+		delete(r.cache, host)
+	}
+}
+
+func lookupSystemHost(ctx context.Context, hostname string) ([]net.IP, error) {
+	resolved, err := net.DefaultResolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]net.IP, len(resolved))
+	for index, address := range resolved {
+		addresses[index] = address.IP
+	}
+	return addresses, nil
+}
+
+// lookupNameServers asks the name servers in turn for the A and AAAA
+// records of hostname. It returns them with the lowest TTL among them.
+func (r *hostResolver) lookupNameServers(ctx context.Context, hostname string) ([]net.IP, time.Duration, error) {
+	var lastErr error
+	for _, nameServer := range r.nameServers {
+		var addresses []net.IP
+		ttl := r.maxTTL
+		failed := false
+		for _, queryType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			answer, err := r.exchange(ctx, hostname, queryType, nameServer)
+			if err != nil {
+				lastErr = err
+				failed = true
+				break
+			}
+			for _, record := range answer.Answer {
+				switch record := record.(type) {
+				case *dns.A:
+					addresses = append(addresses, record.A)
+				case *dns.AAAA:
+					addresses = append(addresses, record.AAAA)
+				default:
+					continue
+				}
+				if recordTTL := time.Duration(record.Header().Ttl) * time.Second; ttl == 0 || recordTTL < ttl {
+					ttl = recordTTL
+				}
+			}
+		}
+		if failed {
+			continue
+		}
+		if len(addresses) == 0 {
+			return nil, 0, fmt.Errorf("%s: %w", hostname, errNoAddresses)
+		}
+		return addresses, ttl, nil
+	}
+	return nil, 0, lastErr
+}
+
+// exchange sends a recursive query to nameServer, retrying over TCP if the
+// answer was truncated.
+func (r *hostResolver) exchange(ctx context.Context, hostname string, queryType uint16, nameServer string) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(hostname), queryType)
+	query.SetEdns0(defaultEDNSBufferSize, false)
+
+	answer, _, err := r.client.ExchangeContext(ctx, query, nameServer)
+	if err == nil && answer.Truncated {
+		tcpClient := &dns.Client{Net: "tcp", Timeout: r.client.Timeout}
+		answer, _, err = tcpClient.ExchangeContext(ctx, query, nameServer)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if answer.Rcode != dns.RcodeSuccess && answer.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s answered %s for %s", nameServer, dns.RcodeToString[answer.Rcode], hostname)
+	}
+	return answer, nil
+}
@@ -0,0 +1,168 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Variables of an ODoH proxy URI template (RFC 9230, Section 4.1)
+	targetHostVariable = "targethost"
+	targetPathVariable = "targetpath"
+)
+
+// proxyURITemplate matches requests against the path and query of an ODoH
+// proxy URI template. As RFC 9230 allows, targethost and targetpath may be
+// path segments, as in "/proxy/{targethost}/{targetpath}/", or query
+// parameters, as in "/dns-proxy{?targethost,targetpath}", which is also how
+// the legacy "/proxy?targethost=...&targetpath=..." endpoint is served.
+type proxyURITemplate struct {
+	template string
+
+	// pattern is the fixed path prefix of the template, which must not be
+	// the root; path matches the whole escaped request path.
+	pattern       string
+	path          *regexp.Regexp
+	pathVariables []string
+}
+
+func newProxyURITemplate(template string) (*proxyURITemplate, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("proxy URI template %q must start with an absolute path", template)
+	}
+	path, query := template, ""
+	if index := strings.Index(template, "{?"); index >= 0 {
+		path, query = template[:index], template[index:]
+		if !strings.HasSuffix(query, "}") || strings.Count(query, "{") != 1 {
+			return nil, fmt.Errorf("query expansion must end proxy URI template %q", template)
+		}
+	}
+	if strings.ContainsAny(path, "?#") {
+		return nil, fmt.Errorf("proxy URI template %q must not contain a literal query or fragment", template)
+	}
+
+	t := &proxyURITemplate{template: template}
+	var expression strings.Builder
+	expression.WriteString("^")
+	for remaining := path; remaining != ""; {
+		start := strings.IndexByte(remaining, '{')
+		if start < 0 {
+			expression.WriteString(regexp.QuoteMeta(remaining))
+			break
+		}
+		end := strings.IndexByte(remaining[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated expression in proxy URI template %q", template)
+		}
+		if t.pattern == "" {
+			t.pattern = remaining[:strings.LastIndexByte(remaining[:start], '/')+1]
+		}
+		expression.WriteString(regexp.QuoteMeta(remaining[:start]))
+		// Simple expansion escapes '/', so a value is within one segment
+		expression.WriteString("([^/]*)")
+		t.pathVariables = append(t.pathVariables, remaining[start+1:start+end])
+		remaining = remaining[start+end+1:]
+	}
+	expression.WriteString("$")
+	if t.pattern == "" {
+		t.pattern = path
+	}
+	if t.pattern == "/" {
+		return nil, fmt.Errorf("proxy URI template %q must start with a fixed path segment", template)
+	}
+	t.path = regexp.MustCompile(expression.String())
+
+	seen := make(map[string]bool)
+	for _, name := range uriTemplateVariables(template) {
+		if name != targetHostVariable && name != targetPathVariable {
+			return nil, fmt.Errorf("unsupported variable %q in proxy URI template %q", name, template)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("variable %q appears twice in proxy URI template %q", name, template)
+		}
+		seen[name] = true
+	}
+	if !seen[targetHostVariable] || !seen[targetPathVariable] {
+		return nil, fmt.Errorf("proxy URI template %q must contain the %s and %s variables", template, targetHostVariable, targetPathVariable)
+	}
+	return t, nil
+}
+
+// matchesPath reports whether the escaped path of r matches the template.
+func (t *proxyURITemplate) matchesPath(r *http.Request) bool {
+	return t.path.MatchString(r.URL.EscapedPath())
+}
+
+// match returns the target host and path of a request for the template.
+// Missing variables are returned empty, for the caller to reject.
+func (t *proxyURITemplate) match(r *http.Request) (targetName string, targetPath string, err error) {
+	segments := t.path.FindStringSubmatch(r.URL.EscapedPath())
+	if segments == nil {
+		return "", "", fmt.Errorf("path %q does not match proxy URI template %q", r.URL.EscapedPath(), t.template)
+	}
+	variables := make(map[string]string)
+	for index, name := range t.pathVariables {
+		value, err := url.PathUnescape(segments[index+1])
+		if err != nil {
+			return "", "", err
+		}
+		variables[name] = value
+	}
+	query := r.URL.Query()
+	for _, name := range []string{targetHostVariable, targetPathVariable} {
+		if _, ok := variables[name]; !ok {
+			variables[name] = query.Get(name)
+		}
+	}
+	return variables[targetHostVariable], variables[targetPathVariable], nil
+}
+
+// proxyTemplateRouter serves the requests matching proxy URI templates and
+// passes other requests on to next. It routes before ServeMux, which would
+// redirect the escaped slashes that path-style templates expand targetpath
+// to.
+type proxyTemplateRouter struct {
+	templates []*proxyURITemplate
+	handlers  []http.Handler
+	next      http.Handler
+}
+
+func (rt *proxyTemplateRouter) handle(template *proxyURITemplate, handler http.Handler) {
+	rt.templates = append(rt.templates, template)
+	rt.handlers = append(rt.handlers, handler)
+}
+
+func (rt *proxyTemplateRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for index, template := range rt.templates {
+		if template.matchesPath(r) {
+			rt.handlers[index].ServeHTTP(w, r)
+			return
+		}
+	}
+	rt.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,149 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const spentTokenFileSuffix = ".spent"
+
+// spentTokenStore remembers the nonces of the tokens redeemed for one issuer
+// key. Tokens are bound to their key, so the nonces only need to be kept as
+// long as the key is in use: rotating the key starts a new, empty store and
+// drops the nonces of the previous key. The store therefore grows with the
+// tokens issued under one key rather than being capped, and issuers bound
+// it by rotating their key.
+//
+// With a directory, nonces are appended to a file named after the token
+// key ID, so that they survive restarts. Before every redemption the store
+// reads what other processes appended, so replicas sharing the directory
+// also reject tokens redeemed by each other, except for two redemptions of
+// the same token racing each other.
+type spentTokenStore struct {
+	sync.Mutex
+	spent  map[[privateTokenNonceLength]byte]struct{}
+	file   *os.File
+	loaded int64
+}
+
+func newSpentTokenStore(directory string, tokenKeyID []byte) (*spentTokenStore, error) {
+	store := &spentTokenStore{spent: make(map[[privateTokenNonceLength]byte]struct{})}
+	if directory == "" {
+		return store, nil
+	}
+
+	name := hex.EncodeToString(tokenKeyID) + spentTokenFileSuffix
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), spentTokenFileSuffix) && entry.Name() != name {
+			log.Printf("Removing redeemed tokens of rotated issuer key %s", entry.Name())
+			if err := os.Remove(filepath.Join(directory, entry.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	store.file, err = os.OpenFile(filepath.Join(directory, name), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.loadLocked(); err != nil {
+		store.file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// loadLocked reads the nonces appended to the file since the last call.
+// A trailing partial nonce, still being written, is read the next time.
+func (s *spentTokenStore) loadLocked() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	length := (info.Size() - s.loaded) / privateTokenNonceLength * privateTokenNonceLength
+	if length <= 0 {
+		return nil
+	}
+	data := make([]byte, length)
+	if _, err := s.file.ReadAt(data, s.loaded); err != nil && err != io.EOF {
+		return err
+	}
+	for offset := 0; offset < len(data); offset += privateTokenNonceLength {
+		var key [privateTokenNonceLength]byte
+		copy(key[:], data[offset:])
+		s.spent[key] = struct{}{}
+	}
+	s.loaded += length
+	return nil
+}
+
+// contains reports whether the token with nonce was redeemed.
+func (s *spentTokenStore) contains(nonce []byte) (bool, error) {
+	var key [privateTokenNonceLength]byte
+	copy(key[:], nonce)
+	s.Lock()
+	defer s.Unlock()
+	if s.file != nil {
+		if err := s.loadLocked(); err != nil {
+			return false, err
+		}
+	}
+	_, ok := s.spent[key]
+	return ok, nil
+}
+
+// spend records the token with nonce as redeemed. It fails with
+// errTokenSpent if it already was.
+func (s *spentTokenStore) spend(nonce []byte) error {
+	var key [privateTokenNonceLength]byte
+	copy(key[:], nonce)
+	s.Lock()
+	defer s.Unlock()
+	if s.file != nil {
+		if err := s.loadLocked(); err != nil {
+			return err
+		}
+	}
+	if _, ok := s.spent[key]; ok {
+		return errTokenSpent
+	}
+	if s.file != nil {
+		if _, err := s.file.Write(key[:]); err != nil {
+			return err
+		}
+	}
+	s.spent[key] = struct{}{}
+	return nil
+}
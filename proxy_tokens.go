@@ -0,0 +1,297 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Privacy Pass token type for blind RSA (RFC 9578, Section 6)
+	privateTokenTypeBlindRSA = uint16(0x0002)
+	privateTokenScheme       = "PrivateToken"
+	privateTokenNonceLength  = 32
+	privateTokenSaltLength   = 48
+)
+
+var (
+	errTokenMissing = errors.New("missing PrivateToken authorization")
+	errTokenInvalid = errors.New("invalid PrivateToken")
+	errTokenSpent   = errors.New("PrivateToken already redeemed")
+
+	oidRSASSAPSS = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidMGF1      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+	oidSHA384    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+)
+
+type rsaPSSParameters struct {
+	Hash       pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MGF        pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+	SaltLength int                      `asn1:"explicit,tag:2"`
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// marshalTokenKey encodes an issuer key as an RSASSA-PSS SubjectPublicKeyInfo
+// with SHA-384 parameters, the encoding token key IDs are computed over
+// (RFC 9578, Section 6.5).
+func marshalTokenKey(publicKey *rsa.PublicKey) ([]byte, error) {
+	sha384 := pkix.AlgorithmIdentifier{Algorithm: oidSHA384, Parameters: asn1.NullRawValue}
+	hashParameters, err := asn1.Marshal(sha384)
+	if err != nil {
+		return nil, err
+	}
+	parameters, err := asn1.Marshal(rsaPSSParameters{
+		Hash:       sha384,
+		MGF:        pkix.AlgorithmIdentifier{Algorithm: oidMGF1, Parameters: asn1.RawValue{FullBytes: hashParameters}},
+		SaltLength: privateTokenSaltLength,
+	})
+	if err != nil {
+		return nil, err
+	}
+	publicKeyBytes := x509.MarshalPKCS1PublicKey(publicKey)
+	return asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSASSAPSS, Parameters: asn1.RawValue{FullBytes: parameters}},
+		PublicKey: asn1.BitString{Bytes: publicKeyBytes, BitLength: 8 * len(publicKeyBytes)},
+	})
+}
+
+// loadTokenKey reads an issuer key from a PEM file holding either the
+// issuer's RSA private key or its public key.
+func loadTokenKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return &privateKey.PublicKey, nil
+	case "PUBLIC KEY":
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		rsaKey, ok := publicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an RSA key", path)
+		}
+		return rsaKey, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported PEM type %q", path, block.Type)
+}
+
+// createTokenChallenge encodes the TokenChallenge clients must redeem tokens
+// for (RFC 9577, Section 2.1). The redemption context is empty, so tokens
+// can be issued ahead of time.
+func createTokenChallenge(issuerName string, originInfo string) []byte {
+	var challenge bytes.Buffer
+	binary.Write(&challenge, binary.BigEndian, privateTokenTypeBlindRSA)
+	binary.Write(&challenge, binary.BigEndian, uint16(len(issuerName)))
+	challenge.WriteString(issuerName)
+	challenge.WriteByte(0)
+	binary.Write(&challenge, binary.BigEndian, uint16(len(originInfo)))
+	challenge.WriteString(originInfo)
+	return challenge.Bytes()
+}
+
+// tokenInput returns the part of a token covered by its authenticator.
+func tokenInput(nonce []byte, challengeDigest []byte, tokenKeyID []byte) []byte {
+	input := make([]byte, 2, 2+len(nonce)+len(challengeDigest)+len(tokenKeyID))
+	binary.BigEndian.PutUint16(input, privateTokenTypeBlindRSA)
+	input = append(input, nonce...)
+	input = append(input, challengeDigest...)
+	return append(input, tokenKeyID...)
+}
+
+// decodeTokenParameter decodes a base64url authentication parameter, with
+// or without padding.
+func decodeTokenParameter(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// parsePrivateTokenAuthorization extracts the token from an Authorization
+// header using the PrivateToken scheme.
+func parsePrivateTokenAuthorization(authorization string) ([]byte, error) {
+	fields := strings.SplitN(strings.TrimSpace(authorization), " ", 2)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], privateTokenScheme) {
+		return nil, errTokenMissing
+	}
+	for _, parameter := range strings.Split(fields[1], ",") {
+		parts := strings.SplitN(strings.TrimSpace(parameter), "=", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], "token") {
+			return decodeTokenParameter(strings.Trim(parts[1], "\""))
+		}
+	}
+	return nil, errTokenMissing
+}
+
+// tokenVerifier accepts each token issued for the proxy's challenge once.
+// Tokens are checked by authorize when a request arrives, but only redeemed
+// once the request was accepted, so that a client does not lose its token
+// to a request the proxy turns down.
+type tokenVerifier struct {
+	publicKey       *rsa.PublicKey
+	challenge       []byte
+	challengeDigest []byte
+	tokenKey        []byte
+	tokenKeyID      []byte
+	spent           *spentTokenStore
+	metrics         *metrics
+}
+
+func newTokenVerifier(publicKey *rsa.PublicKey, issuerName string, originInfo string, storeDirectory string, metrics *metrics) (*tokenVerifier, error) {
+	tokenKey, err := marshalTokenKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	challenge := createTokenChallenge(issuerName, originInfo)
+	challengeDigest := sha256.Sum256(challenge)
+	tokenKeyID := sha256.Sum256(tokenKey)
+	spent, err := newSpentTokenStore(storeDirectory, tokenKeyID[:])
+	if err != nil {
+		return nil, err
+	}
+	return &tokenVerifier{
+		publicKey:       publicKey,
+		challenge:       challenge,
+		challengeDigest: challengeDigest[:],
+		tokenKey:        tokenKey,
+		tokenKeyID:      tokenKeyID[:],
+		spent:           spent,
+		metrics:         metrics,
+	}, nil
+}
+
+// verify checks the token carried by an Authorization header and returns
+// its nonce, without redeeming it.
+func (v *tokenVerifier) verify(authorization string) ([]byte, error) {
+	token, err := parsePrivateTokenAuthorization(authorization)
+	if err != nil {
+		return nil, errTokenMissing
+	}
+
+	authenticatorLength := v.publicKey.Size()
+	inputLength := 2 + privateTokenNonceLength + sha256.Size + sha256.Size
+	if len(token) != inputLength+authenticatorLength {
+		return nil, errTokenInvalid
+	}
+	if binary.BigEndian.Uint16(token) != privateTokenTypeBlindRSA {
+		return nil, errTokenInvalid
+	}
+	nonce := token[2 : 2+privateTokenNonceLength]
+	challengeDigest := token[2+privateTokenNonceLength : 2+privateTokenNonceLength+sha256.Size]
+	tokenKeyID := token[2+privateTokenNonceLength+sha256.Size : inputLength]
+	if !bytes.Equal(challengeDigest, v.challengeDigest) || !bytes.Equal(tokenKeyID, v.tokenKeyID) {
+		return nil, errTokenInvalid
+	}
+
+	digest := crypto.SHA384.New()
+	digest.Write(token[:inputLength])
+	options := &rsa.PSSOptions{SaltLength: privateTokenSaltLength, Hash: crypto.SHA384}
+	if err := rsa.VerifyPSS(v.publicKey, crypto.SHA384, digest.Sum(nil), token[inputLength:], options); err != nil {
+		return nil, errTokenInvalid
+	}
+
+	spent, err := v.spent.contains(nonce)
+	if err != nil {
+		return nil, err
+	}
+	if spent {
+		return nil, errTokenSpent
+	}
+	return nonce, nil
+}
+
+// challengeHeader returns the WWW-Authenticate value asking for a token.
+func (v *tokenVerifier) challengeHeader() string {
+	return fmt.Sprintf("%s challenge=\"%s\", token-key=\"%s\"", privateTokenScheme,
+		base64.RawURLEncoding.EncodeToString(v.challenge),
+		base64.RawURLEncoding.EncodeToString(v.tokenKey))
+}
+
+// authorize verifies the token of a client request and returns its nonce,
+// for redeem. It answers 401 with a challenge if the token is missing or
+// not acceptable.
+func (v *tokenVerifier) authorize(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	nonce, err := v.verify(r.Header.Get("Authorization"))
+	if err != nil {
+		v.reject(w, err)
+		return nil, false
+	}
+	return nonce, true
+}
+
+// redeem spends the token with nonce, once the request carrying it was
+// accepted. It fails like authorize if the token was redeemed meanwhile.
+func (v *tokenVerifier) redeem(w http.ResponseWriter, nonce []byte) bool {
+	if err := v.spent.spend(nonce); err != nil {
+		v.reject(w, err)
+		return false
+	}
+	v.metrics.increment("proxy_token_redeemed")
+	return true
+}
+
+func (v *tokenVerifier) reject(w http.ResponseWriter, err error) {
+	switch err {
+	case errTokenMissing:
+		v.metrics.increment("proxy_token_missing")
+	case errTokenSpent:
+		v.metrics.increment("proxy_token_spent")
+	case errTokenInvalid:
+		v.metrics.increment("proxy_token_invalid")
+	default:
+		log.Println("Failed checking redeemed tokens:", err)
+		v.metrics.increment("proxy_token_store_error")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", v.challengeHeader())
+	http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(http.StatusUnauthorized), err), http.StatusUnauthorized)
+}
@@ -0,0 +1,249 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// rfc9474Vector is a test vector of RFC 9474, Appendix A.
+type rfc9474Vector struct {
+	P          string `json:"p"`
+	Q          string `json:"q"`
+	N          string `json:"n"`
+	E          string `json:"e"`
+	D          string `json:"d"`
+	InputMsg   string `json:"input_msg"`
+	Salt       string `json:"salt"`
+	EncodedMsg string `json:"encoded_msg"`
+	Inv        string `json:"inv"`
+	BlindedMsg string `json:"blinded_msg"`
+	BlindSig   string `json:"blind_sig"`
+	Sig        string `json:"sig"`
+}
+
+func decodeVectorHex(t *testing.T, value string) []byte {
+	data, err := hex.DecodeString(strings.TrimPrefix(value, "0x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func decodeVectorInt(t *testing.T, value string) *big.Int {
+	return new(big.Int).SetBytes(decodeVectorHex(t, value))
+}
+
+func TestBlindRSAVector(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/rfc9474_pss_deterministic.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vector rfc9474Vector
+	if err := json.Unmarshal(data, &vector); err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{
+			N: decodeVectorInt(t, vector.N),
+			E: int(decodeVectorInt(t, vector.E).Int64()),
+		},
+		D:      decodeVectorInt(t, vector.D),
+		Primes: []*big.Int{decodeVectorInt(t, vector.P), decodeVectorInt(t, vector.Q)},
+	}
+	if err := privateKey.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	publicKey := &privateKey.PublicKey
+	input := decodeVectorHex(t, vector.InputMsg)
+	salt := decodeVectorHex(t, vector.Salt)
+
+	encoded, err := emsaPSSEncode(input, publicKey.N.BitLen(), salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := decodeVectorHex(t, vector.EncodedMsg); !bytes.Equal(encoded, want) {
+		t.Fatalf("encoded message = %x, want %x", encoded, want)
+	}
+
+	r := new(big.Int).ModInverse(decodeVectorInt(t, vector.Inv), publicKey.N)
+	req, err := blindMessage(publicKey, input, salt, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := decodeVectorHex(t, vector.BlindedMsg); !bytes.Equal(req.blinded, want) {
+		t.Fatalf("blinded message = %x, want %x", req.blinded, want)
+	}
+
+	blindSignature, err := blindSign(privateKey, req.blinded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := decodeVectorHex(t, vector.BlindSig); !bytes.Equal(blindSignature, want) {
+		t.Fatalf("blind signature = %x, want %x", blindSignature, want)
+	}
+
+	token, err := req.finalize(publicKey, blindSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(input, decodeVectorHex(t, vector.Sig)...); !bytes.Equal(token, want) {
+		t.Fatalf("token = %x, want %x", token, want)
+	}
+}
+
+// issueTestToken runs a blind issuance for challenge and returns the
+// Authorization header carrying the token.
+func issueTestToken(t *testing.T, privateKey *rsa.PrivateKey, challenge []byte) string {
+	req, err := blindTokenRequest(&privateKey.PublicKey, challenge, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindSignature, err := blindSign(privateKey, req.blinded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := req.finalize(&privateKey.PublicKey, blindSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s token=\"%s\"", privateTokenScheme, base64.RawURLEncoding.EncodeToString(token))
+}
+
+// authorizeTestToken runs authorize, and redeem if the token is accepted,
+// and returns the status of the response.
+func authorizeTestToken(verifier *tokenVerifier, authorization string, redeem bool) int {
+	r := httptest.NewRequest(http.MethodPost, "/proxy", nil)
+	r.Header.Set("Authorization", authorization)
+	w := httptest.NewRecorder()
+	nonce, ok := verifier.authorize(w, r)
+	if ok && redeem {
+		verifier.redeem(w, nonce)
+	}
+	return w.Code
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	directory, err := ioutil.TempDir("", "odoh-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, tokenIssuerKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := newTokenVerifier(&privateKey.PublicKey, "issuer.example", "", directory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorization := issueTestToken(t, privateKey, verifier.challenge)
+
+	if code := authorizeTestToken(verifier, authorization, false); code != http.StatusOK {
+		t.Fatalf("unredeemed token: status %d, want %d", code, http.StatusOK)
+	}
+	if code := authorizeTestToken(verifier, authorization, true); code != http.StatusOK {
+		t.Fatalf("first redemption: status %d, want %d", code, http.StatusOK)
+	}
+	if code := authorizeTestToken(verifier, authorization, true); code != http.StatusUnauthorized {
+		t.Fatalf("second redemption: status %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	restarted, err := newTokenVerifier(&privateKey.PublicKey, "issuer.example", "", directory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := authorizeTestToken(restarted, authorization, true); code != http.StatusUnauthorized {
+		t.Fatalf("redemption after restart: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := authorizeTestToken(restarted, issueTestToken(t, privateKey, verifier.challenge), true); code != http.StatusOK {
+		t.Fatalf("fresh token after restart: status %d, want %d", code, http.StatusOK)
+	}
+
+	other, err := newTokenVerifier(&privateKey.PublicKey, "other.example", "", directory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := authorizeTestToken(other, authorization, true); code != http.StatusUnauthorized {
+		t.Fatalf("token for another challenge: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	w := httptest.NewRecorder()
+	other.reject(w, errTokenMissing)
+	if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), privateTokenScheme+" challenge=") {
+		t.Fatalf("missing challenge in %q", w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestSpentTokenStoreRotation(t *testing.T) {
+	directory, err := ioutil.TempDir("", "odoh-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	nonce := bytes.Repeat([]byte{1}, privateTokenNonceLength)
+	first, err := newSpentTokenStore(directory, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := newSpentTokenStore(directory, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.spend(nonce); err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.spend(nonce); err != errTokenSpent {
+		t.Fatalf("spend on replica = %v, want %v", err, errTokenSpent)
+	}
+
+	rotated, err := newSpentTokenStore(directory, []byte{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spent, err := rotated.contains(nonce); err != nil || spent {
+		t.Fatalf("contains after rotation = %v, %v, want false", spent, err)
+	}
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "02"+spentTokenFileSuffix {
+		t.Fatalf("store files after rotation: %v", entries)
+	}
+}
@@ -0,0 +1,456 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"golang.org/x/net/http2"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Protocols offered to targets when HTTP/2 is forced or merely preferred
+var (
+	http2OnlyProtocols = []string{"h2"}
+	http1Protocols     = []string{"http/1.1"}
+)
+
+var errTargetNotHTTP2 = errors.New("target did not negotiate HTTP/2")
+
+const (
+	// Longest a connection told to go away may finish its running requests
+	connDrainTimeout = time.Minute
+
+	// Targets with statistics of their own; others are counted together
+	maxPoolStatsTargets = 1000
+	otherTargets        = "other"
+)
+
+// targetPoolStats describes the connections of the proxy to one target.
+type targetPoolStats struct {
+	Dials         uint64 `json:"dials"`
+	DialErrors    uint64 `json:"dial_errors"`
+	Resumed       uint64 `json:"tls_resumed"`
+	Requests      uint64 `json:"requests"`
+	Open          int    `json:"open"`
+	ActiveStreams int    `json:"active_streams"`
+}
+
+// poolStatistics collects targetPoolStats for the first maxPoolStatsTargets
+// targets and for all others together. Entries are never removed, so that
+// the updates for a connection always land on the same entry.
+type poolStatistics struct {
+	sync.Mutex
+	targets map[string]*targetPoolStats
+}
+
+func newPoolStatistics() *poolStatistics {
+	return &poolStatistics{targets: make(map[string]*targetPoolStats)}
+}
+
+func (s *poolStatistics) update(address string, change func(*targetPoolStats)) {
+	s.Lock()
+	defer s.Unlock()
+	stats, ok := s.targets[address]
+	if !ok {
+		if len(s.targets) >= maxPoolStatsTargets {
+			address = otherTargets
+		}
+		if stats, ok = s.targets[address]; !ok {
+			stats = &targetPoolStats{}
+			s.targets[address] = stats
+		}
+	}
+	change(stats)
+}
+
+// totals returns the statistics of all targets summed up. Unlike the
+// per-target breakdown, they reveal nothing about where clients send
+// their queries, so they can be published with the other metrics.
+func (s *poolStatistics) totals() interface{} {
+	s.Lock()
+	defer s.Unlock()
+	var totals targetPoolStats
+	for _, stats := range s.targets {
+		totals.Dials += stats.Dials
+		totals.DialErrors += stats.DialErrors
+		totals.Resumed += stats.Resumed
+		totals.Requests += stats.Requests
+		totals.Open += stats.Open
+		totals.ActiveStreams += stats.ActiveStreams
+	}
+	return totals
+}
+
+// poolsHandler serves the statistics of every target. It must only be
+// reachable by operators.
+func (s *poolStatistics) poolsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s Handling %s\n", r.Method, r.URL.Path)
+
+	s.Lock()
+	snapshot := make(map[string]targetPoolStats, len(s.targets))
+	for address, stats := range s.targets {
+		snapshot[address] = *stats
+	}
+	s.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// countedConn reports its closing to the pool statistics.
+type countedConn struct {
+	*tls.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// dialTarget makes a TLS connection to a target and records it in stats.
+func dialTarget(ctx context.Context, dialer *targetDialer, stats *poolStatistics, network string, address string) (*countedConn, error) {
+	tlsConn, err := dialer.DialTLSContext(ctx, network, address)
+	if err != nil {
+		stats.update(address, func(s *targetPoolStats) { s.DialErrors++ })
+		return nil, err
+	}
+	resumed := tlsConn.ConnectionState().DidResume
+	stats.update(address, func(s *targetPoolStats) {
+		s.Dials++
+		s.Open++
+		if resumed {
+			s.Resumed++
+		}
+	})
+	return &countedConn{Conn: tlsConn, onClose: func() {
+		stats.update(address, func(s *targetPoolStats) { s.Open-- })
+	}}, nil
+}
+
+// pooledConn is an HTTP/2 connection to a target and its use.
+type pooledConn struct {
+	conn     *http2.ClientConn
+	active   int
+	lastUsed time.Time
+}
+
+type targetPool struct {
+	conns   []*pooledConn
+	dialing int
+	// Closed and replaced whenever a stream or connection slot frees up
+	released chan struct{}
+}
+
+// http2TargetTransport sends every proxied request over HTTP/2. It keeps up
+// to maxConnsPerHost connections per target, or any number if it is 0,
+// each carrying up to
+// maxConcurrentStreams requests, so that bursts reuse warm connections
+// instead of paying for new handshakes.
+type http2TargetTransport struct {
+	sync.Mutex
+	transport            *http2.Transport
+	dialer               *targetDialer
+	stats                *poolStatistics
+	maxConnsPerHost      int
+	maxConcurrentStreams int
+	idleTimeout          time.Duration
+	pools                map[string]*targetPool
+}
+
+func newHTTP2TargetTransport(dialer *targetDialer, stats *poolStatistics, maxConnsPerHost int, maxConcurrentStreams int, idleTimeout time.Duration, pingInterval time.Duration, pingTimeout time.Duration) *http2TargetTransport {
+	t := &http2TargetTransport{
+		dialer:               dialer,
+		stats:                stats,
+		maxConnsPerHost:      maxConnsPerHost,
+		maxConcurrentStreams: maxConcurrentStreams,
+		idleTimeout:          idleTimeout,
+		pools:                make(map[string]*targetPool),
+	}
+	t.transport = &http2.Transport{
+		ConnPool:                   t,
+		StrictMaxConcurrentStreams: true,
+		ReadIdleTimeout:            pingInterval,
+		PingTimeout:                pingTimeout,
+	}
+	if idleTimeout > 0 {
+		go t.closeIdleConnections()
+	}
+	return t
+}
+
+// GetClientConn and MarkDead make the transport the connection pool of its
+// HTTP/2 transport, which uses it for health checks. Requests are only sent
+// through RoundTrip, which picks connections itself.
+func (t *http2TargetTransport) GetClientConn(req *http.Request, address string) (*http2.ClientConn, error) {
+	return nil, http2.ErrNoCachedConn
+}
+
+func (t *http2TargetTransport) MarkDead(conn *http2.ClientConn) {
+	t.Lock()
+	defer t.Unlock()
+	for _, pool := range t.pools {
+		for index, pooled := range pool.conns {
+			if pooled.conn == conn {
+				t.removeLocked(pool, index)
+				return
+			}
+		}
+	}
+}
+
+// removeLocked forgets the connection at index of pool and closes it once
+// its running requests are done, so that a target going away gracefully
+// does not fail them.
+func (t *http2TargetTransport) removeLocked(pool *targetPool, index int) {
+	pooled := pool.conns[index]
+	pool.conns = append(pool.conns[:index], pool.conns[index+1:]...)
+	go drainConn(pooled.conn)
+	t.notifyLocked(pool)
+}
+
+func drainConn(conn *http2.ClientConn) {
+	ctx, cancel := context.WithTimeout(context.Background(), connDrainTimeout)
+	defer cancel()
+	if err := conn.Shutdown(ctx); err != nil {
+		conn.Close()
+	}
+}
+
+func (t *http2TargetTransport) notifyLocked(pool *targetPool) {
+	close(pool.released)
+	pool.released = make(chan struct{})
+}
+
+// acquire returns a connection to address with a free stream, dialing one
+// if the pool has room, or waiting for a stream otherwise.
+func (t *http2TargetTransport) acquire(ctx context.Context, address string) (*pooledConn, error) {
+	for {
+		t.Lock()
+		pool, ok := t.pools[address]
+		if !ok {
+			pool = &targetPool{released: make(chan struct{})}
+			t.pools[address] = pool
+		}
+
+		var best *pooledConn
+		for index := 0; index < len(pool.conns); index++ {
+			pooled := pool.conns[index]
+			if !pooled.conn.CanTakeNewRequest() {
+				t.removeLocked(pool, index)
+				index--
+				continue
+			}
+			if pooled.active < t.maxConcurrentStreams && (best == nil || pooled.active < best.active) {
+				best = pooled
+			}
+		}
+		if best != nil {
+			best.active++
+			best.lastUsed = time.Now()
+			t.Unlock()
+			return best, nil
+		}
+
+		if t.maxConnsPerHost == 0 || len(pool.conns)+pool.dialing < t.maxConnsPerHost {
+			pool.dialing++
+			t.Unlock()
+			pooled, err := t.dial(ctx, address)
+			t.Lock()
+			pool.dialing--
+			if err != nil {
+				t.notifyLocked(pool)
+				t.Unlock()
+				return nil, err
+			}
+			pooled.active++
+			pool.conns = append(pool.conns, pooled)
+			t.Unlock()
+			return pooled, nil
+		}
+
+		released := pool.released
+		t.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (t *http2TargetTransport) dial(ctx context.Context, address string) (*pooledConn, error) {
+	conn, err := dialTarget(ctx, t.dialer, t.stats, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if conn.ConnectionState().NegotiatedProtocol != "h2" {
+		conn.Close()
+		return nil, errTargetNotHTTP2
+	}
+	clientConn, err := t.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &pooledConn{conn: clientConn, lastUsed: time.Now()}, nil
+}
+
+// release returns the stream of a finished request to the pool.
+func (t *http2TargetTransport) release(address string, pooled *pooledConn) {
+	t.Lock()
+	defer t.Unlock()
+	pooled.active--
+	pooled.lastUsed = time.Now()
+	if pool, ok := t.pools[address]; ok {
+		t.notifyLocked(pool)
+	}
+	t.stats.update(address, func(s *targetPoolStats) { s.ActiveStreams-- })
+}
+
+// closeIdleConnections periodically closes connections that carried no
+// request for idleTimeout.
+func (t *http2TargetTransport) closeIdleConnections() {
+	ticker := time.NewTicker(t.idleTimeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.Lock()
+		for address, pool := range t.pools {
+			for index := 0; index < len(pool.conns); index++ {
+				if pooled := pool.conns[index]; pooled.active == 0 && time.Since(pooled.lastUsed) > t.idleTimeout {
+					t.removeLocked(pool, index)
+					index--
+				}
+			}
+			if len(pool.conns) == 0 && pool.dialing == 0 {
+				delete(t.pools, address)
+			}
+		}
+		t.Unlock()
+	}
+}
+
+// releasingBody releases the stream of a request once its response body
+// has been read or closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// targetAddress returns the host and port a request is sent to.
+func targetAddress(req *http.Request) string {
+	if req.URL.Port() == "" {
+		return net.JoinHostPort(req.URL.Hostname(), "443")
+	}
+	return req.URL.Host
+}
+
+func (t *http2TargetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	address := targetAddress(req)
+
+	pooled, err := t.acquire(req.Context(), address)
+	if err != nil {
+		// The request never reaches a ClientConn, so its body is ours to
+		// close as the RoundTripper contract requires.
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	cover := isCoverRequest(req.Context())
+	t.stats.update(address, func(s *targetPoolStats) {
+		if !cover {
+			s.Requests++
+		}
+		s.ActiveStreams++
+	})
+
+	resp, err := pooled.conn.RoundTrip(req)
+	if err != nil {
+		t.release(address, pooled)
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { t.release(address, pooled) }}
+	return resp, nil
+}
+
+// newProxyTransport builds the transport the proxy uses towards targets.
+// With forceHTTP2 every request goes over a pooled HTTP/2 connection with
+// keepalive pings; otherwise targets are spoken to over HTTP/1.1.
+func newProxyTransport(config proxyTransportConfig, dialer *targetDialer, maxIdleConnsPerHost int, stats *poolStatistics) http.RoundTripper {
+	dialer.tls.config.ClientSessionCache = tls.NewLRUClientSessionCache(config.SessionCacheSize)
+	if config.ForceHTTP2 {
+		dialer.tls.config.NextProtos = http2OnlyProtocols
+		return newHTTP2TargetTransport(dialer, stats, config.MaxConnsPerHost, config.MaxConcurrentStreams,
+			time.Duration(config.IdleConnTimeout), time.Duration(config.PingInterval), time.Duration(config.PingTimeout))
+	}
+
+	dialer.tls.config.NextProtos = http1Protocols
+	return &countingTransport{
+		transport: &http.Transport{
+			DialTLSContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				return dialTarget(ctx, dialer, stats, network, address)
+			},
+			MaxIdleConnsPerHost: maxIdleConnsPerHost,
+			MaxConnsPerHost:     config.MaxConnsPerHost,
+			IdleConnTimeout:     time.Duration(config.IdleConnTimeout),
+		},
+		stats: stats,
+	}
+}
+
+// countingTransport records the requests sent through an HTTP/1.1 transport.
+type countingTransport struct {
+	transport *http.Transport
+	stats     *poolStatistics
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isCoverRequest(req.Context()) {
+		t.stats.update(targetAddress(req), func(s *targetPoolStats) { s.Requests++ })
+	}
+	return t.transport.RoundTrip(req)
+}
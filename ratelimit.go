@@ -0,0 +1,164 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a simple token bucket rate limiter. Tokens are replenished
+// continuously at rate per second up to burst.
+type tokenBucket struct {
+	sync.Mutex
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:       rate,
+		burst:      float64(burst),
+		tokens:     float64(burst),
+		lastRefill: time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	if elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.lastRefill = now
+	}
+}
+
+// allow consumes a token if one is available and reports whether it did.
+func (b *tokenBucket) allow() bool {
+	allowed, _ := b.reserve()
+	return allowed
+}
+
+// reserve consumes a token if one is available. Otherwise it returns how
+// long it will take for the next token to become available.
+func (b *tokenBucket) reserve() (bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		if b.rate <= 0 {
+			return false, time.Duration(1<<63 - 1)
+		}
+		return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+type keyedBucket struct {
+	key    string
+	bucket *tokenBucket
+}
+
+// keyedRateLimiter keeps a token bucket per key, such as a client address,
+// and remembers at most maxKeys of them. When full, it forgets the key used
+// least recently, whose bucket is the most likely to have refilled.
+type keyedRateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   int
+	maxKeys int
+	buckets map[string]*list.Element
+	// Buckets ordered from the most to the least recently used
+	recent *list.List
+}
+
+func newKeyedRateLimiter(rate float64, burst int, maxKeys int) *keyedRateLimiter {
+	return &keyedRateLimiter{
+		rate:    rate,
+		burst:   burst,
+		maxKeys: maxKeys,
+		buckets: make(map[string]*list.Element),
+		recent:  list.New(),
+	}
+}
+
+// reserve consumes a token from the bucket for key. See tokenBucket.reserve.
+func (l *keyedRateLimiter) reserve(key string) (bool, time.Duration) {
+	l.Lock()
+	element, ok := l.buckets[key]
+	if ok {
+		l.recent.MoveToFront(element)
+	} else {
+		if len(l.buckets) >= l.maxKeys {
+			oldest := l.recent.Back()
+			l.recent.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*keyedBucket).key)
+		}
+		element = l.recent.PushFront(&keyedBucket{key: key, bucket: newTokenBucket(l.rate, l.burst)})
+		l.buckets[key] = element
+	}
+	bucket := element.Value.(*keyedBucket).bucket
+	l.Unlock()
+
+	return bucket.reserve()
+}
+
+// clientRateLimitKey returns the rate limiting key for a client connecting
+// from remoteAddr. IPv6 clients are keyed by their /64, since a single
+// client typically controls a whole /64.
+func clientRateLimitKey(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// writeRateLimited answers a request refused by a rate limiter, telling the
+// client to retry once a token will be available.
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+	retryAfter := int64(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
@@ -0,0 +1,51 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestKeyedRateLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	limiter := newKeyedRateLimiter(0, 1, 2)
+	for _, test := range []struct {
+		key     string
+		allowed bool
+	}{
+		{key: "a", allowed: true},
+		{key: "b", allowed: true},
+		{key: "a", allowed: false},
+		// The limiter is full: c replaces b, used less recently than a.
+		{key: "c", allowed: true},
+		{key: "a", allowed: false},
+		{key: "b", allowed: true},
+		{key: "c", allowed: true},
+	} {
+		if allowed, _ := limiter.reserve(test.key); allowed != test.allowed {
+			t.Fatalf("reserve(%q) = %v, want %v", test.key, allowed, test.allowed)
+		}
+	}
+	if len(limiter.buckets) != 2 || limiter.recent.Len() != 2 {
+		t.Fatalf("limiter remembers %d keys, want 2", len(limiter.buckets))
+	}
+}
@@ -23,24 +23,40 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"github.com/chris-wood/odoh"
 	"github.com/miekg/dns"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
 	"time"
 )
 
+const (
+	// How long proxies and clients may cache the published configurations
+	targetConfigMaxAge = time.Hour
+
+	// Queries per second repeated with checking disabled to tell DNSSEC
+	// failures from other upstream failures
+	dnssecProbeRate = 10
+)
+
 type targetServer struct {
 	verbose            bool
-	resolver           []*targetResolver
+	resolver           []queryResolver
 	odohKeyPair        odoh.ObliviousDoHKeyPair
 	telemetryClient    *telemetry
 	serverInstanceName string
 	experimentId       string
+	blockedDomains     []string
+	queryLimiter       *tokenBucket
+	staleCache         *staleAnswerCache
+	dnssecProbes       *tokenBucket
+	dns64              *dns64Synthesizer
+	proxyAuth          *proxyAuthenticator
 }
 
 func decodeDNSQuestion(encodedMessage []byte) (*dns.Msg, error) {
@@ -49,6 +65,17 @@ func decodeDNSQuestion(encodedMessage []byte) (*dns.Msg, error) {
 	return msg, err
 }
 
+// malformedDNSQuestion returns the query to answer with FORMERR in place of
+// encodedMessage, which could not be decoded. It keeps the message ID, if
+// there is one, so that the client can match the answer.
+func malformedDNSQuestion(encodedMessage []byte) *dns.Msg {
+	msg := &dns.Msg{}
+	if len(encodedMessage) >= 2 {
+		msg.Id = binary.BigEndian.Uint16(encodedMessage)
+	}
+	return msg
+}
+
 func (s *targetServer) parseQueryFromRequest(r *http.Request) (*dns.Msg, error) {
 	switch r.Method {
 	case "GET":
@@ -56,6 +83,9 @@ func (s *targetServer) parseQueryFromRequest(r *http.Request) (*dns.Msg, error)
 		if queryBody = r.URL.Query().Get("dns"); queryBody == "" {
 			return nil, fmt.Errorf("Missing DNS query parameter in GET request")
 		}
+		if len(queryBody) > maxDNSQueryParameterLength {
+			return nil, errQueryTooLarge
+		}
 
 		encodedMessage, err := base64.RawURLEncoding.DecodeString(queryBody)
 		if err != nil {
@@ -68,8 +98,7 @@ func (s *targetServer) parseQueryFromRequest(r *http.Request) (*dns.Msg, error)
 			return nil, fmt.Errorf("incorrect content type, expected 'application/dns-message', got %s", r.Header.Get("Content-Type"))
 		}
 
-		defer r.Body.Close()
-		encodedMessage, err := ioutil.ReadAll(r.Body)
+		encodedMessage, err := readRequestBody(r, maxDNSMessageSize)
 		if err != nil {
 			return nil, err
 		}
@@ -80,7 +109,11 @@ func (s *targetServer) parseQueryFromRequest(r *http.Request) (*dns.Msg, error)
 	}
 }
 
-func (s *targetServer) resolveQuery(query *dns.Msg, chosenResolver int) ([]byte, error) {
+func (s *targetServer) resolveQuery(ctx context.Context, query *dns.Msg, chosenResolver int) ([]byte, error) {
+	return s.resolveQueryWithResolver(ctx, query, s.resolver[chosenResolver])
+}
+
+func (s *targetServer) resolveQueryWithResolver(ctx context.Context, query *dns.Msg, resolver queryResolver) ([]byte, error) {
 	packedQuery, err := query.Pack()
 	if err != nil {
 		log.Println("Failed encoding DNS query:", err)
@@ -92,8 +125,11 @@ func (s *targetServer) resolveQuery(query *dns.Msg, chosenResolver int) ([]byte,
 	}
 
 	start := time.Now()
-	response, err := s.resolver[chosenResolver].resolve(query)
+	response, err := s.answerQuery(ctx, query, resolver)
 	elapsed := time.Now().Sub(start)
+	if err != nil {
+		return nil, err
+	}
 
 	packedResponse, err := response.Pack()
 	if err != nil {
@@ -108,32 +144,124 @@ func (s *targetServer) resolveQuery(query *dns.Msg, chosenResolver int) ([]byte,
 	return packedResponse, err
 }
 
-func (s *targetServer) resolveQueryWithResolver(query *dns.Msg, resolver *targetResolver) ([]byte, error) {
-	packedQuery, err := query.Pack()
+func (s *targetServer) isBlockedQuery(query *dns.Msg) bool {
+	for _, question := range query.Question {
+		for _, domain := range s.blockedDomains {
+			if dns.IsSubDomain(dns.Fqdn(domain), question.Name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// answerQuery applies the target's local policy to query and resolves it
+// with resolver. Errors returned from answerQuery describe why no upstream
+// answer is available and are turned into DNS answers by the caller.
+func (s *targetServer) answerQuery(ctx context.Context, query *dns.Msg, resolver queryResolver) (*dns.Msg, error) {
+	if s.queryLimiter != nil && !s.queryLimiter.allow() {
+		return nil, errQueryRateLimited
+	}
+	if s.isBlockedQuery(query) {
+		return nil, errQueryBlocked
+	}
+
+	response, err := resolver.resolve(ctx, query)
 	if err != nil {
-		log.Println("Failed encoding DNS query:", err)
+		if staleResponse, ok := s.lookupStale(query, err); ok {
+			return staleResponse, nil
+		}
 		return nil, err
 	}
 
-	if s.verbose {
-		log.Printf("Query=%s\n", packedQuery)
+	if response.Rcode == dns.RcodeServerFailure {
+		// DNSSEC failures are reported as they are rather than hidden by a
+		// stale answer.
+		if hasDNSSECError(response) {
+			return response, nil
+		}
+		if s.isDNSSECFailure(ctx, query, response, resolver) {
+			return nil, errDNSSECBogus
+		}
+		if synthesized, ok := s.synthesizeAAAA(ctx, query, response, resolver); ok {
+			return synthesized, nil
+		}
+		if staleResponse, ok := s.lookupStale(query, fmt.Errorf("%s answered SERVFAIL", resolver.getResolverServerName())); ok {
+			return staleResponse, nil
+		}
+		return response, nil
 	}
 
-	start := time.Now()
-	response, err := resolver.resolve(query)
-	elapsed := time.Now().Sub(start)
+	if s.staleCache != nil {
+		s.staleCache.store(query, response)
+	}
+
+	if synthesized, ok := s.synthesizeAAAA(ctx, query, response, resolver); ok {
+		return synthesized, nil
+	}
 
+	return response, nil
+}
+
+// synthesizeAAAA returns the DNS64 answer to query if DNS64 is enabled and
+// response carries no usable AAAA records.
+func (s *targetServer) synthesizeAAAA(ctx context.Context, query *dns.Msg, response *dns.Msg, resolver queryResolver) (*dns.Msg, bool) {
+	if s.dns64 == nil || !s.dns64.needsSynthesis(query, response) {
+		return nil, false
+	}
+	ipv4Response, err := resolver.resolve(ctx, createIPv4Query(query))
+	if err != nil {
+		log.Println("Failed resolving A query for DNS64 synthesis:", err)
+		return nil, false
+	}
+	if ipv4Response.Rcode != dns.RcodeSuccess {
+		return nil, false
+	}
+	return s.dns64.synthesize(query, response, ipv4Response)
+}
+
+// lookupStale returns a stale answer to query, if one is cached, in place
+// of the failure err.
+func (s *targetServer) lookupStale(query *dns.Msg, err error) (*dns.Msg, bool) {
+	if s.staleCache == nil {
+		return nil, false
+	}
+	staleResponse, ok := s.staleCache.lookupStale(query)
+	if ok {
+		log.Println("Serving stale answer after resolution failure:", err)
+	}
+	return staleResponse, ok
+}
+
+// isDNSSECFailure reports whether the SERVFAIL response of a validating
+// upstream without any Extended DNS Error is caused by DNSSEC validation,
+// that is whether the same query succeeds with checking disabled. Only
+// dnssecProbes such queries are repeated per second.
+func (s *targetServer) isDNSSECFailure(ctx context.Context, query *dns.Msg, response *dns.Msg, resolver queryResolver) bool {
+	if query.CheckingDisabled || hasExtendedDNSError(response) {
+		return false
+	}
+	if s.dnssecProbes != nil && !s.dnssecProbes.allow() {
+		return false
+	}
+	unvalidatedQuery := query.Copy()
+	unvalidatedQuery.CheckingDisabled = true
+	unvalidatedResponse, err := resolver.resolve(ctx, unvalidatedQuery)
+	return err == nil && unvalidatedResponse.Rcode != dns.RcodeServerFailure
+}
+
+func (s *targetServer) createErrorResponseForQuery(query *dns.Msg, resolutionErr error) ([]byte, error) {
+	response := createErrorResponseForError(query, resolutionErr)
 	packedResponse, err := response.Pack()
 	if err != nil {
-		log.Println("Failed encoding DNS response:", err)
 		return nil, err
 	}
 
 	if s.verbose {
-		log.Printf("Answer=%s elapsed=%s\n", packedResponse, elapsed.String())
+		log.Printf("Answer=%s (synthesized)\n", packedResponse)
 	}
 
-	return packedResponse, err
+	return packedResponse, nil
 }
 
 func (s *targetServer) plainQueryHandler(w http.ResponseWriter, r *http.Request) {
@@ -152,16 +280,23 @@ func (s *targetServer) plainQueryHandler(w http.ResponseWriter, r *http.Request)
 	query, err := s.parseQueryFromRequest(r)
 	if err != nil {
 		log.Println("Failed parsing request:", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		status := requestErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
 	timestamp.TargetQueryDecryptionTime = time.Now().UnixNano()
 
-	packedResponse, err := s.resolveQuery(query, chosenResolver)
+	resolutionSucceeded := true
+	packedResponse, err := s.resolveQuery(r.Context(), query, chosenResolver)
 	if err != nil {
 		log.Println("Failed resolving DNS query:", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		resolutionSucceeded = false
+		packedResponse, err = s.createErrorResponseForQuery(query, err)
+		if err != nil {
+			log.Println("Failed encoding DNS error response:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
 	}
 	endTime := time.Now().UnixNano()
 	timestamp.TargetQueryResolutionTime = endTime
@@ -170,7 +305,7 @@ func (s *targetServer) plainQueryHandler(w http.ResponseWriter, r *http.Request)
 
 	exp.Timestamp = timestamp
 	exp.Resolver = s.resolver[chosenResolver].getResolverServerName()
-	exp.Status = true
+	exp.Status = resolutionSucceeded
 
 	if s.telemetryClient.logClient != nil {
 		go s.telemetryClient.streamTelemetryToGCPLogging([]string{exp.serialize()})
@@ -183,14 +318,13 @@ func (s *targetServer) plainQueryHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *targetServer) parseObliviousQueryFromRequest(r *http.Request) (*odoh.ObliviousDNSQuery, odoh.ResponseContext, error) {
-	defer r.Body.Close()
-	encryptedMessageBytes, err := ioutil.ReadAll(r.Body)
+	encryptedMessageBytes, err := readRequestBody(r, maxObliviousMessageSize)
 	if err != nil {
 		log.Println("Failed reading oblivious query body:", err)
 		return nil, odoh.ResponseContext{}, err
 	}
 
-	obliviousMessage, err := odoh.UnmarshalDNSMessage(encryptedMessageBytes)
+	obliviousMessage, err := unmarshalObliviousMessage(encryptedMessageBytes, odoh.QueryType)
 	if err != nil {
 		log.Println("Failed decoding oblivious DNS message:", err)
 		return nil, odoh.ResponseContext{},err
@@ -221,27 +355,41 @@ func (s *targetServer) obliviousQueryHandler(w http.ResponseWriter, r *http.Requ
 	timestamp.Start = requestReceivedTime.UnixNano()
 	obliviousQuery, responseContext, err := s.parseObliviousQueryFromRequest(r)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		status := requestErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
 
+	// A query that cannot be decoded is answered with FORMERR, sealed like
+	// any other answer, since only the client can read what went wrong.
+	var packedResponse []byte
 	query, err := decodeDNSQuestion(obliviousQuery.Message())
 	if err != nil {
 		log.Println("Failed decoding DNS query:", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
+		query = malformedDNSQuestion(obliviousQuery.Message())
+		err = errMalformedQuery
 	}
 
 	queryParseAndDecryptionCompleteTime := time.Now().UnixNano()
 	timestamp.TargetQueryDecryptionTime = queryParseAndDecryptionCompleteTime
 
-	chosenResolver := int(query.Id) % len(nameServers)
+	chosenResolver := int(query.Id) % len(s.resolver)
 	resolverChosen := s.resolver[chosenResolver]
-	packedResponse, err := s.resolveQueryWithResolver(query, resolverChosen)
+	resolutionSucceeded := true
+	if err == nil {
+		packedResponse, err = s.resolveQueryWithResolver(r.Context(), query, resolverChosen)
+	}
 	if err != nil {
+		// Resolution failures are reported to the client inside the encrypted
+		// envelope so that the proxy cannot observe them.
 		log.Println("Failed resolving DNS query:", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		resolutionSucceeded = false
+		packedResponse, err = s.createErrorResponseForQuery(query, err)
+		if err != nil {
+			log.Println("Failed encoding DNS error response:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
 	}
 
 	queryResolutionCompleteTime := time.Now().UnixNano()
@@ -277,7 +425,7 @@ func (s *targetServer) obliviousQueryHandler(w http.ResponseWriter, r *http.Requ
 
 	exp.Timestamp = timestamp
 	exp.Resolver = s.resolver[chosenResolver].getResolverServerName()
-	exp.Status = true
+	exp.Status = resolutionSucceeded
 
 	if s.telemetryClient.logClient != nil {
 		go s.telemetryClient.streamTelemetryToGCPLogging([]string{exp.serialize()})
@@ -297,6 +445,14 @@ func (s *targetServer) serverWebPvD(w http.ResponseWriter, r *http.Request) {
 func (s *targetServer) targetQueryHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("%s Handling %s\n", r.Method, r.URL.Path)
 
+	if s.proxyAuth != nil {
+		if err := s.proxyAuth.checkRequest(r); err != nil {
+			log.Println("Rejecting query:", err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
 	targetName := r.URL.Query().Get("targethost")
 	if targetName != "" {
 		log.Printf("Proxy request made via dns-query request interface. Use /proxy instead")
@@ -319,5 +475,6 @@ func (s *targetServer) configHandler(w http.ResponseWriter, r *http.Request) {
 
 	configSet := []odoh.ObliviousDoHConfig{s.odohKeyPair.Config}
 	configs := odoh.CreateObliviousDoHConfigs(configSet)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", targetConfigMaxAge/time.Second))
 	w.Write(configs.Marshal())
 }
@@ -0,0 +1,166 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TTL given to records in stale answers (RFC 8767, Section 4)
+	staleAnswerTTL = 30
+)
+
+type staleCacheEntry struct {
+	response *dns.Msg
+	expires  time.Time
+}
+
+// staleAnswerCache remembers recent upstream answers so that they can be
+// served, marked as stale, when every upstream fails (RFC 8767).
+type staleAnswerCache struct {
+	sync.Mutex
+	entries    map[string]staleCacheEntry
+	maxEntries int
+	maxStale   time.Duration
+}
+
+func newStaleAnswerCache(maxEntries int, maxStale time.Duration) *staleAnswerCache {
+	return &staleAnswerCache{
+		entries:    make(map[string]staleCacheEntry),
+		maxEntries: maxEntries,
+		maxStale:   maxStale,
+	}
+}
+
+// staleCacheKey keys answers by question and by the CD bit, so that an
+// answer fetched with checking disabled, and thus not validated, is never
+// served to a query that asked for DNSSEC validation.
+func staleCacheKey(query *dns.Msg) (string, bool) {
+	if len(query.Question) != 1 {
+		return "", false
+	}
+	question := query.Question[0]
+	key := strings.ToLower(question.Name) + "/" + dns.TypeToString[question.Qtype] + "/" + dns.ClassToString[question.Qclass]
+	if query.CheckingDisabled {
+		key += "/cd"
+	}
+	return key, true
+}
+
+func minimumTTL(response *dns.Msg) uint32 {
+	minTTL := uint32(0)
+	first := true
+	for _, section := range [][]dns.RR{response.Answer, response.Ns} {
+		for _, rr := range section {
+			if ttl := rr.Header().Ttl; first || ttl < minTTL {
+				minTTL = ttl
+				first = false
+			}
+		}
+	}
+	return minTTL
+}
+
+// store records response as the answer to query.
+func (c *staleAnswerCache) store(query *dns.Msg, response *dns.Msg) {
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return
+	}
+	key, ok := staleCacheKey(query)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	entry := staleCacheEntry{
+		response: response.Copy(),
+		expires:  now.Add(time.Duration(minimumTTL(response)) * time.Second),
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = entry
+}
+
+// evict drops entries that can no longer be served and, if the cache is
+// still full, an arbitrary entry. It must be called with the lock held.
+func (c *staleAnswerCache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if now.Sub(entry.expires) > c.maxStale {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.maxEntries {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// lookupStale returns a stale answer to query, if one is available. The
+// answer carries a Stale Answer, or Stale NXDOMAIN Answer, Extended DNS
+// Error.
+func (c *staleAnswerCache) lookupStale(query *dns.Msg) (*dns.Msg, bool) {
+	key, ok := staleCacheKey(query)
+	if !ok {
+		return nil, false
+	}
+
+	c.Lock()
+	entry, ok := c.entries[key]
+	c.Unlock()
+	if !ok || time.Now().Sub(entry.expires) > c.maxStale {
+		return nil, false
+	}
+
+	response := entry.response.Copy()
+	response.Id = query.Id
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = staleAnswerTTL
+			}
+		}
+	}
+
+	do := false
+	if opt := query.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	infoCode := edeStaleAnswer
+	if response.Rcode == dns.RcodeNameError {
+		infoCode = edeStaleNXDomainAnswer
+	}
+	addExtendedDNSError(response, do, infoCode, "")
+
+	return response, true
+}
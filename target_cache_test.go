@@ -0,0 +1,246 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+// stubUpstream answers queries with checking enabled from validated and
+// queries with checking disabled from unvalidated, counting the queries.
+type stubUpstream struct {
+	validated   func(query *dns.Msg) (*dns.Msg, error)
+	unvalidated func(query *dns.Msg) (*dns.Msg, error)
+	queries     int
+}
+
+func (u *stubUpstream) resolve(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	u.queries++
+	if query.CheckingDisabled && u.unvalidated != nil {
+		return u.unvalidated(query)
+	}
+	return u.validated(query)
+}
+
+func (u *stubUpstream) getResolverServerName() string {
+	return "stub"
+}
+
+func stubAnswer(rcode int, records ...string) func(query *dns.Msg) (*dns.Msg, error) {
+	return func(query *dns.Msg) (*dns.Msg, error) {
+		response := new(dns.Msg)
+		response.SetRcode(query, rcode)
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				return nil, err
+			}
+			response.Answer = append(response.Answer, rr)
+		}
+		return response, nil
+	}
+}
+
+func stubAnswerWithEDE(rcode int, infoCode uint16) func(query *dns.Msg) (*dns.Msg, error) {
+	return func(query *dns.Msg) (*dns.Msg, error) {
+		response := createErrorResponse(query, rcode, infoCode, "")
+		return response, nil
+	}
+}
+
+func stubFailure(query *dns.Msg) (*dns.Msg, error) {
+	return nil, errors.New("upstream unreachable")
+}
+
+func TestAnswerQueryStaleAndDNSSEC(t *testing.T) {
+	success := stubAnswer(dns.RcodeSuccess, "example.com. 0 IN A 192.0.2.1")
+	serverFailure := stubAnswer(dns.RcodeServerFailure)
+
+	for _, test := range []struct {
+		name     string
+		cached   func(query *dns.Msg) (*dns.Msg, error)
+		maxStale time.Duration
+		upstream stubUpstream
+		probes   *tokenBucket
+		rcode    int
+		ede      []uint16
+		queries  int
+	}{
+		{
+			name:     "fresh answer",
+			upstream: stubUpstream{validated: success},
+			rcode:    dns.RcodeSuccess,
+			queries:  1,
+		},
+		{
+			name:     "stale answer on transport error",
+			cached:   success,
+			maxStale: time.Hour,
+			upstream: stubUpstream{validated: stubFailure},
+			rcode:    dns.RcodeSuccess,
+			ede:      []uint16{edeStaleAnswer},
+			queries:  1,
+		},
+		{
+			name:     "stale NXDOMAIN on transport error",
+			cached:   stubAnswer(dns.RcodeNameError),
+			maxStale: time.Hour,
+			upstream: stubUpstream{validated: stubFailure},
+			rcode:    dns.RcodeNameError,
+			ede:      []uint16{edeStaleNXDomainAnswer},
+			queries:  1,
+		},
+		{
+			name:     "no answer past the stale limit",
+			cached:   success,
+			upstream: stubUpstream{validated: stubFailure},
+			rcode:    dns.RcodeServerFailure,
+			ede:      []uint16{edeOther},
+			queries:  1,
+		},
+		{
+			name:     "stale answer on SERVFAIL",
+			cached:   success,
+			maxStale: time.Hour,
+			upstream: stubUpstream{validated: serverFailure},
+			rcode:    dns.RcodeSuccess,
+			ede:      []uint16{edeStaleAnswer},
+			queries:  2,
+		},
+		{
+			name:     "SERVFAIL without stale answer",
+			upstream: stubUpstream{validated: serverFailure},
+			rcode:    dns.RcodeServerFailure,
+			queries:  2,
+		},
+		{
+			name:     "bogus answer detected with checking disabled",
+			cached:   success,
+			maxStale: time.Hour,
+			upstream: stubUpstream{validated: serverFailure, unvalidated: success},
+			rcode:    dns.RcodeServerFailure,
+			ede:      []uint16{edeDNSSECBogus},
+			queries:  2,
+		},
+		{
+			name:     "bogus answer reported by upstream",
+			cached:   success,
+			maxStale: time.Hour,
+			upstream: stubUpstream{validated: stubAnswerWithEDE(dns.RcodeServerFailure, 7), unvalidated: success},
+			rcode:    dns.RcodeServerFailure,
+			ede:      []uint16{7},
+			queries:  1,
+		},
+		{
+			name:     "no probe beyond the probe rate",
+			upstream: stubUpstream{validated: serverFailure, unvalidated: success},
+			probes:   newTokenBucket(0, 0),
+			rcode:    dns.RcodeServerFailure,
+			queries:  1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := &targetServer{
+				staleCache:   newStaleAnswerCache(10, test.maxStale),
+				dnssecProbes: test.probes,
+			}
+			query := new(dns.Msg)
+			query.SetQuestion("example.com.", dns.TypeA)
+			if test.cached != nil {
+				cached, err := test.cached(query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.staleCache.store(query, cached)
+				time.Sleep(time.Millisecond)
+			}
+
+			upstream := test.upstream
+			response, err := s.answerQuery(context.Background(), query, &upstream)
+			if err != nil {
+				response = createErrorResponseForError(query, err)
+			}
+			if response.Rcode != test.rcode {
+				t.Errorf("rcode %s, want %s", dns.RcodeToString[response.Rcode], dns.RcodeToString[test.rcode])
+			}
+			if codes := extendedDNSErrorCodes(response); fmt.Sprint(codes) != fmt.Sprint(test.ede) {
+				t.Errorf("EDE %v, want %v", codes, test.ede)
+			}
+			if upstream.queries != test.queries {
+				t.Errorf("%d upstream queries, want %d", upstream.queries, test.queries)
+			}
+		})
+	}
+}
+
+func TestStaleAnswerWithCheckingDisabledNotServedToValidatingQuery(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		upstream func(query *dns.Msg) (*dns.Msg, error)
+		probes   *tokenBucket
+	}{
+		{name: "transport error", upstream: stubFailure},
+		{name: "SERVFAIL beyond the probe rate", upstream: stubAnswer(dns.RcodeServerFailure), probes: newTokenBucket(0, 0)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := &targetServer{
+				staleCache:   newStaleAnswerCache(10, time.Hour),
+				dnssecProbes: test.probes,
+			}
+
+			unvalidatedQuery := new(dns.Msg)
+			unvalidatedQuery.SetQuestion("example.com.", dns.TypeA)
+			unvalidatedQuery.CheckingDisabled = true
+			upstream := stubUpstream{validated: stubAnswer(dns.RcodeSuccess, "example.com. 0 IN A 192.0.2.1")}
+			if _, err := s.answerQuery(context.Background(), unvalidatedQuery, &upstream); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+
+			query := new(dns.Msg)
+			query.SetQuestion("example.com.", dns.TypeA)
+			upstream = stubUpstream{validated: test.upstream}
+			response, err := s.answerQuery(context.Background(), query, &upstream)
+			if err != nil {
+				response = createErrorResponseForError(query, err)
+			}
+			if response.Rcode != dns.RcodeServerFailure || len(response.Answer) != 0 {
+				t.Errorf("validating query answered with %s and %d records, want SERVFAIL without records", dns.RcodeToString[response.Rcode], len(response.Answer))
+			}
+
+			upstream = stubUpstream{validated: test.upstream}
+			response, err = s.answerQuery(context.Background(), unvalidatedQuery, &upstream)
+			if err != nil {
+				response = createErrorResponseForError(unvalidatedQuery, err)
+			}
+			if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 {
+				t.Errorf("query with checking disabled answered with %s and %d records, want the stale answer", dns.RcodeToString[response.Rcode], len(response.Answer))
+			}
+		})
+	}
+}
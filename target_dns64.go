@@ -0,0 +1,206 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+const (
+	// Well-Known Prefix for IPv4-embedded IPv6 addresses (RFC 6052, Section 2.1)
+	defaultDNS64Prefix = "64:ff9b::/96"
+)
+
+var (
+	// IPv4-mapped addresses are never acceptable AAAA answers (RFC 6147, Section 5.1.4)
+	defaultDNS64ExcludedIPv6 = []string{"::ffff:0:0/96"}
+)
+
+// dns64Synthesizer synthesizes AAAA records from A records for names that
+// have no usable IPv6 address, as described in RFC 6147.
+type dns64Synthesizer struct {
+	prefix       *net.IPNet
+	excludedIPv6 []*net.IPNet
+	excludedIPv4 []*net.IPNet
+}
+
+func newDNS64Synthesizer(prefix string, exclusions []string) (*dns64Synthesizer, error) {
+	_, prefixNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS64 prefix %s: %w", prefix, err)
+	}
+	if !strings.Contains(prefix, ":") {
+		return nil, fmt.Errorf("invalid DNS64 prefix %s: not an IPv6 prefix", prefix)
+	}
+	switch prefixLength, _ := prefixNet.Mask.Size(); prefixLength {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("invalid DNS64 prefix %s: length must be one of 32, 40, 48, 56, 64 or 96", prefix)
+	}
+
+	synthesizer := &dns64Synthesizer{
+		prefix: prefixNet,
+	}
+	for _, exclusion := range append(defaultDNS64ExcludedIPv6, exclusions...) {
+		_, excludedNet, err := net.ParseCIDR(exclusion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS64 exclusion %s: %w", exclusion, err)
+		}
+		// IPv4-mapped prefixes are IPv6 exclusions even though their
+		// address has an IPv4 form, so classify on the notation instead.
+		if !strings.Contains(exclusion, ":") {
+			synthesizer.excludedIPv4 = append(synthesizer.excludedIPv4, excludedNet)
+		} else {
+			synthesizer.excludedIPv6 = append(synthesizer.excludedIPv6, excludedNet)
+		}
+	}
+
+	return synthesizer, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// embedIPv4 builds the IPv4-embedded IPv6 address for ipv4 under the
+// configured prefix, skipping bits 64 to 71 (RFC 6052, Section 2.2).
+func (d *dns64Synthesizer) embedIPv4(ipv4 net.IP) net.IP {
+	prefixLength, _ := d.prefix.Mask.Size()
+	address := make(net.IP, net.IPv6len)
+	copy(address, d.prefix.IP.To16())
+
+	offset := prefixLength / 8
+	for _, b := range ipv4.To4() {
+		if offset == 8 {
+			offset++
+		}
+		address[offset] = b
+		offset++
+	}
+	return address
+}
+
+// needsSynthesis reports whether response to an AAAA query carries no
+// usable AAAA records and should be replaced by a synthesized answer.
+func (d *dns64Synthesizer) needsSynthesis(query *dns.Msg, response *dns.Msg) bool {
+	if len(query.Question) != 1 {
+		return false
+	}
+	question := query.Question[0]
+	if question.Qtype != dns.TypeAAAA || question.Qclass != dns.ClassINET {
+		return false
+	}
+
+	// Validating clients must see the real answer (RFC 6147, Section 5.5)
+	if opt := query.IsEdns0(); opt != nil && opt.Do() && query.CheckingDisabled {
+		return false
+	}
+
+	// A name that does not exist has no A records either, while any other
+	// error is treated as an empty answer (RFC 6147, Section 5.1.2)
+	if response.Rcode == dns.RcodeNameError {
+		return false
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		return true
+	}
+	for _, rr := range response.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok && !containsIP(d.excludedIPv6, aaaa.AAAA) {
+			return false
+		}
+	}
+	return true
+}
+
+// synthesize builds the answer to the AAAA query from the answer to the
+// corresponding A query. The original response supplies the negative
+// caching TTL that bounds the synthesized records (RFC 6147, Section 5.1.7).
+func (d *dns64Synthesizer) synthesize(query *dns.Msg, response *dns.Msg, ipv4Response *dns.Msg) (*dns.Msg, bool) {
+	maxTTL := uint32(0)
+	hasMaxTTL := false
+	for _, rr := range response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			maxTTL = soa.Minttl
+			if soa.Hdr.Ttl < maxTTL {
+				maxTTL = soa.Hdr.Ttl
+			}
+			hasMaxTTL = true
+		}
+	}
+
+	synthesized := ipv4Response.Copy()
+	synthesized.Id = query.Id
+	synthesized.Question = query.Question
+	synthesized.AuthenticatedData = false
+	synthesized.Answer = nil
+
+	for _, rr := range ipv4Response.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			if rr.Header().Rrtype != dns.TypeRRSIG {
+				synthesized.Answer = append(synthesized.Answer, dns.Copy(rr))
+			}
+			continue
+		}
+		if containsIP(d.excludedIPv4, a.A) {
+			continue
+		}
+
+		ttl := a.Hdr.Ttl
+		if hasMaxTTL && maxTTL < ttl {
+			ttl = maxTTL
+		}
+		synthesized.Answer = append(synthesized.Answer, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   a.Hdr.Name,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			AAAA: d.embedIPv4(a.A),
+		})
+	}
+
+	for _, rr := range synthesized.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return synthesized, true
+		}
+	}
+	return nil, false
+}
+
+// createIPv4Query derives the A query used to synthesize an answer to the
+// AAAA query.
+func createIPv4Query(query *dns.Msg) *dns.Msg {
+	ipv4Query := query.Copy()
+	ipv4Query.Question[0].Qtype = dns.TypeA
+	return ipv4Query
+}
@@ -0,0 +1,161 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestEmbedIPv4(t *testing.T) {
+	// Examples from RFC 6052, Section 2.4
+	for _, test := range []struct {
+		prefix  string
+		address string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+	} {
+		t.Run(test.prefix, func(t *testing.T) {
+			synthesizer, err := newDNS64Synthesizer(test.prefix, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			address := synthesizer.embedIPv4(net.ParseIP("192.0.2.33"))
+			if !address.Equal(net.ParseIP(test.address)) {
+				t.Errorf("embedded address %s, want %s", address, test.address)
+			}
+			if address[8] != 0 {
+				t.Errorf("bits 64 to 71 of %s are %#x, want 0", address, address[8])
+			}
+		})
+	}
+}
+
+func TestNeedsSynthesis(t *testing.T) {
+	synthesizer, err := newDNS64Synthesizer(defaultDNS64Prefix, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		qtype     uint16
+		do        bool
+		cd        bool
+		rcode     int
+		records   []string
+		synthesis bool
+	}{
+		{name: "no AAAA records", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, synthesis: true},
+		{name: "AAAA record", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, records: []string{"example.com. 300 IN AAAA 2001:db8::1"}},
+		{name: "only excluded AAAA records", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, records: []string{"example.com. 300 IN AAAA ::ffff:192.0.2.1"}, synthesis: true},
+		{name: "CNAME without AAAA records", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, records: []string{"example.com. 300 IN CNAME www.example.net."}, synthesis: true},
+		{name: "NXDOMAIN", qtype: dns.TypeAAAA, rcode: dns.RcodeNameError},
+		{name: "SERVFAIL", qtype: dns.TypeAAAA, rcode: dns.RcodeServerFailure, synthesis: true},
+		{name: "REFUSED", qtype: dns.TypeAAAA, rcode: dns.RcodeRefused, synthesis: true},
+		{name: "A query", qtype: dns.TypeA, rcode: dns.RcodeSuccess},
+		{name: "DNSSEC OK", qtype: dns.TypeAAAA, do: true, rcode: dns.RcodeSuccess, synthesis: true},
+		{name: "checking disabled", qtype: dns.TypeAAAA, cd: true, rcode: dns.RcodeSuccess, synthesis: true},
+		{name: "DNSSEC OK and checking disabled", qtype: dns.TypeAAAA, do: true, cd: true, rcode: dns.RcodeSuccess},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			query := new(dns.Msg)
+			query.SetQuestion("example.com.", test.qtype)
+			query.CheckingDisabled = test.cd
+			if test.do {
+				query.SetEdns0(4096, true)
+			}
+			response, err := stubAnswer(test.rcode, test.records...)(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if synthesis := synthesizer.needsSynthesis(query, response); synthesis != test.synthesis {
+				t.Errorf("needsSynthesis %v, want %v", synthesis, test.synthesis)
+			}
+		})
+	}
+}
+
+func TestSynthesizeExcludesIPv4(t *testing.T) {
+	synthesizer, err := newDNS64Synthesizer(defaultDNS64Prefix, []string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeAAAA)
+	response, err := stubAnswer(dns.RcodeSuccess)(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ipv4Response, err := stubAnswer(dns.RcodeSuccess, "example.com. 300 IN A 192.0.2.1", "example.com. 300 IN A 198.51.100.1")(createIPv4Query(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	synthesized, ok := synthesizer.synthesize(query, response, ipv4Response)
+	if !ok {
+		t.Fatal("no answer synthesized")
+	}
+	if len(synthesized.Answer) != 1 || !synthesized.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("64:ff9b::198.51.100.1")) {
+		t.Errorf("synthesized %v, want only 64:ff9b::198.51.100.1", synthesized.Answer)
+	}
+
+	ipv4Response, err = stubAnswer(dns.RcodeSuccess, "example.com. 300 IN A 192.0.2.1")(createIPv4Query(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synthesized, ok := synthesizer.synthesize(query, response, ipv4Response); ok {
+		t.Errorf("synthesized %v from excluded addresses only", synthesized.Answer)
+	}
+}
+
+func TestAnswerQuerySynthesizesOnServerFailure(t *testing.T) {
+	synthesizer, err := newDNS64Synthesizer(defaultDNS64Prefix, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &targetServer{dns64: synthesizer}
+	upstream := stubUpstream{validated: func(query *dns.Msg) (*dns.Msg, error) {
+		if query.Question[0].Qtype == dns.TypeA {
+			return stubAnswer(dns.RcodeSuccess, "example.com. 300 IN A 192.0.2.1")(query)
+		}
+		return stubAnswerWithEDE(dns.RcodeServerFailure, edeNoReachableAuthority)(query)
+	}}
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeAAAA)
+	response, err := s.answerQuery(context.Background(), query, &upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 || !response.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("64:ff9b::192.0.2.1")) {
+		t.Errorf("answer %s %v, want 64:ff9b::192.0.2.1", dns.RcodeToString[response.Rcode], response.Answer)
+	}
+}
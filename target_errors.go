@@ -0,0 +1,171 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+)
+
+const (
+	// EDNS(0) option code for Extended DNS Errors (RFC 8914, Section 2)
+	ednsOptionCodeEDE = 15
+
+	// Extended DNS Error info codes (RFC 8914, Section 4)
+	edeOther                = uint16(0)
+	edeStaleAnswer          = uint16(3)
+	edeDNSSECBogus          = uint16(6)
+	edeBlocked              = uint16(15)
+	edeStaleNXDomainAnswer  = uint16(19)
+	edeNoReachableAuthority = uint16(22)
+	edeNetworkError         = uint16(23)
+
+	// Default EDNS(0) UDP payload size advertised in locally generated answers
+	defaultEDNSBufferSize = 1232
+)
+
+// extendedDNSError is returned when the target decides to answer a query
+// itself rather than relay an upstream answer. It carries the rcode and
+// Extended DNS Error that the synthesized answer should contain.
+type extendedDNSError struct {
+	rcode     int
+	infoCode  uint16
+	extraText string
+	err       error
+}
+
+func (e *extendedDNSError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("%s (EDE %d): %v", dns.RcodeToString[e.rcode], e.infoCode, e.err)
+	}
+	return fmt.Sprintf("%s (EDE %d): %s", dns.RcodeToString[e.rcode], e.infoCode, e.extraText)
+}
+
+func (e *extendedDNSError) Unwrap() error {
+	return e.err
+}
+
+var (
+	errQueryBlocked     = &extendedDNSError{rcode: dns.RcodeRefused, infoCode: edeBlocked, extraText: "blocked by policy"}
+	errMalformedQuery   = &extendedDNSError{rcode: dns.RcodeFormatError, infoCode: edeOther, extraText: "malformed query"}
+	errQueryRateLimited = &extendedDNSError{rcode: dns.RcodeRefused, infoCode: edeOther, extraText: "rate limited"}
+	errDNSSECBogus      = &extendedDNSError{rcode: dns.RcodeServerFailure, infoCode: edeDNSSECBogus, extraText: "DNSSEC validation failed"}
+)
+
+// classifyResolutionError maps an error returned while resolving a query to
+// the rcode, Extended DNS Error info code and extra text that best describe it.
+func classifyResolutionError(err error) (int, uint16, string) {
+	var extendedErr *extendedDNSError
+	if errors.As(err, &extendedErr) {
+		return extendedErr.rcode, extendedErr.infoCode, extendedErr.extraText
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return dns.RcodeServerFailure, edeNoReachableAuthority, "upstream timeout"
+		}
+		return dns.RcodeServerFailure, edeNetworkError, "upstream network error"
+	}
+	return dns.RcodeServerFailure, edeOther, ""
+}
+
+// createExtendedDNSErrorOption builds the EDE option carrying infoCode and
+// an optional human readable extraText.
+func createExtendedDNSErrorOption(infoCode uint16, extraText string) *dns.EDNS0_LOCAL {
+	data := make([]byte, 2+len(extraText))
+	binary.BigEndian.PutUint16(data, infoCode)
+	copy(data[2:], extraText)
+	return &dns.EDNS0_LOCAL{
+		Code: ednsOptionCodeEDE,
+		Data: data,
+	}
+}
+
+// hasExtendedDNSError reports whether msg already carries an EDE option.
+func hasExtendedDNSError(msg *dns.Msg) bool {
+	return len(extendedDNSErrorCodes(msg)) > 0
+}
+
+// extendedDNSErrorCodes returns the info codes of the EDE options of msg.
+func extendedDNSErrorCodes(msg *dns.Msg) []uint16 {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	var codes []uint16
+	for _, option := range opt.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == ednsOptionCodeEDE && len(local.Data) >= 2 {
+			codes = append(codes, binary.BigEndian.Uint16(local.Data))
+		}
+	}
+	return codes
+}
+
+// hasDNSSECError reports whether msg carries an EDE reporting a DNSSEC
+// validation failure: codes 1, 2 and 5 to 12 (RFC 8914, Section 4).
+func hasDNSSECError(msg *dns.Msg) bool {
+	for _, code := range extendedDNSErrorCodes(msg) {
+		if code == 1 || code == 2 || (code >= 5 && code <= 12) {
+			return true
+		}
+	}
+	return false
+}
+
+// addExtendedDNSError attaches an EDE option to msg, adding an OPT record if
+// the message does not have one yet.
+func addExtendedDNSError(msg *dns.Msg, do bool, infoCode uint16, extraText string) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(defaultEDNSBufferSize, do)
+		opt = msg.IsEdns0()
+	}
+	opt.Option = append(opt.Option, createExtendedDNSErrorOption(infoCode, extraText))
+}
+
+// createErrorResponse synthesizes an answer to query with the given rcode
+// and attaches an Extended DNS Error explaining why it was generated.
+func createErrorResponse(query *dns.Msg, rcode int, infoCode uint16, extraText string) *dns.Msg {
+	response := new(dns.Msg)
+	response.SetRcode(query, rcode)
+	response.RecursionAvailable = true
+
+	do := false
+	if opt := query.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	addExtendedDNSError(response, do, infoCode, extraText)
+
+	return response
+}
+
+// createErrorResponseForError synthesizes the answer to query that
+// describes resolutionErr.
+func createErrorResponseForError(query *dns.Msg, resolutionErr error) *dns.Msg {
+	rcode, infoCode, extraText := classifyResolutionError(resolutionErr)
+	return createErrorResponse(query, rcode, infoCode, extraText)
+}
@@ -0,0 +1,592 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Nested resolutions (CNAME targets, glueless name servers) per query
+	maxRecursionDepth = 8
+	// Referrals followed while resolving a single name
+	maxReferrals = 16
+	// Queries sent to authoritative servers on behalf of a single client query
+	maxQueriesPerResolution = 64
+	// Delegations remembered by the recursive resolver
+	maxDelegationCacheEntries = 10000
+	// Answers remembered by the recursive resolver
+	maxAnswerCacheEntries = 10000
+
+	defaultAuthorityPort = "53"
+)
+
+var (
+	// IPv4 addresses of the root servers, a.root-servers.net to m.root-servers.net
+	defaultRootHints = []string{
+		"198.41.0.4", "199.9.14.201", "192.33.4.12", "199.7.91.13",
+		"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+		"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+		"202.12.27.33",
+	}
+
+	errRecursionLimit = &extendedDNSError{rcode: dns.RcodeServerFailure, infoCode: edeOther, extraText: "recursion limit exceeded"}
+	errRecursionLoop  = &extendedDNSError{rcode: dns.RcodeServerFailure, infoCode: edeOther, extraText: "resolution loop detected"}
+	errRecursionTime  = &extendedDNSError{rcode: dns.RcodeServerFailure, infoCode: edeNoReachableAuthority, extraText: "resolution timed out"}
+)
+
+type delegation struct {
+	zone    string
+	servers []string
+	expires time.Time
+}
+
+// delegationCache remembers the name servers, and their addresses, that
+// are authoritative for zones seen in referrals.
+type delegationCache struct {
+	sync.Mutex
+	entries    map[string]delegation
+	maxEntries int
+}
+
+func newDelegationCache(maxEntries int) *delegationCache {
+	return &delegationCache{
+		entries:    make(map[string]delegation),
+		maxEntries: maxEntries,
+	}
+}
+
+func (c *delegationCache) store(entry delegation) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, exists := c.entries[entry.zone]; !exists && len(c.entries) >= c.maxEntries {
+		now := time.Now()
+		for zone, cached := range c.entries {
+			if now.After(cached.expires) || len(c.entries) >= c.maxEntries {
+				delete(c.entries, zone)
+			}
+		}
+	}
+	c.entries[entry.zone] = entry
+}
+
+// closest returns the cached delegation for the zone closest to name.
+func (c *delegationCache) closest(name string) (delegation, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	for zone := name; ; {
+		if entry, ok := c.entries[zone]; ok && now.Before(entry.expires) {
+			return entry, true
+		}
+		if zone == "." {
+			return delegation{}, false
+		}
+		zone = parentZone(zone)
+	}
+}
+
+type cachedAnswer struct {
+	response *dns.Msg
+	stored   time.Time
+	expires  time.Time
+}
+
+// answerCache remembers the answers of authoritative servers, positive and
+// negative, so that repeated questions are answered without walking the
+// delegations down to the servers again.
+type answerCache struct {
+	sync.Mutex
+	entries    map[string]cachedAnswer
+	maxEntries int
+}
+
+func newAnswerCache(maxEntries int) *answerCache {
+	return &answerCache{
+		entries:    make(map[string]cachedAnswer),
+		maxEntries: maxEntries,
+	}
+}
+
+// answerTTL returns how long response may be cached: the lowest TTL of its
+// answers or, for negative answers, of the SOA record (RFC 2308, Section 5).
+func answerTTL(response *dns.Msg) (uint32, bool) {
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+	records := response.Answer
+	if len(records) == 0 || response.Rcode == dns.RcodeNameError {
+		records = nil
+		for _, rr := range response.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				return ttl, ttl > 0
+			}
+		}
+	}
+	if len(records) == 0 {
+		return 0, false
+	}
+	ttl := records[0].Header().Ttl
+	for _, rr := range records[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl, ttl > 0
+}
+
+func (c *answerCache) store(key string, response *dns.Msg) {
+	ttl, ok := answerTTL(response)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	entry := cachedAnswer{
+		response: response.Copy(),
+		stored:   now,
+		expires:  now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		for cachedKey, cached := range c.entries {
+			if now.After(cached.expires) || len(c.entries) >= c.maxEntries {
+				delete(c.entries, cachedKey)
+			}
+		}
+	}
+	c.entries[key] = entry
+}
+
+// lookup returns a copy of the answer cached for key, with its TTLs reduced
+// by the time spent in the cache.
+func (c *answerCache) lookup(key string) (*dns.Msg, bool) {
+	c.Lock()
+	entry, ok := c.entries[key]
+	c.Unlock()
+	now := time.Now()
+	if !ok || !now.Before(entry.expires) {
+		return nil, false
+	}
+
+	response := entry.response.Copy()
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{response.Answer, response.Ns} {
+		for _, rr := range section {
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return response, true
+}
+
+func parentZone(name string) string {
+	offset, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[offset:]
+}
+
+// lastLabels returns the suffix of name made of its last count labels.
+func lastLabels(name string, count int) string {
+	indexes := dns.Split(name)
+	if count >= len(indexes) {
+		return name
+	}
+	return name[indexes[len(indexes)-count]:]
+}
+
+// recursionState tracks the work done on behalf of a single client query.
+// Its context carries the deadline of the whole resolution.
+type recursionState struct {
+	ctx     context.Context
+	queries int
+	active  map[string]bool
+}
+
+// recursiveResolver resolves queries iteratively starting from the root
+// hints, without relying on any third-party recursive resolver.
+type recursiveResolver struct {
+	rootHints         []string
+	port              string
+	timeout           time.Duration
+	resolutionTimeout time.Duration
+	qnameMinimization bool
+	cache             *delegationCache
+	answers           *answerCache
+}
+
+// newRecursiveResolver returns a resolver querying each authoritative server
+// for at most timeout and spending at most resolutionTimeout on a query.
+func newRecursiveResolver(rootHints []string, port string, timeout time.Duration, resolutionTimeout time.Duration) *recursiveResolver {
+	servers := make([]string, len(rootHints))
+	for index, hint := range rootHints {
+		servers[index] = net.JoinHostPort(hint, port)
+	}
+	return &recursiveResolver{
+		rootHints:         servers,
+		port:              port,
+		timeout:           timeout,
+		resolutionTimeout: resolutionTimeout,
+		qnameMinimization: true,
+		cache:             newDelegationCache(maxDelegationCacheEntries),
+		answers:           newAnswerCache(maxAnswerCacheEntries),
+	}
+}
+
+func (r *recursiveResolver) getResolverServerName() string {
+	return "recursive"
+}
+
+func (r *recursiveResolver) resolve(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	if len(query.Question) != 1 {
+		return nil, &extendedDNSError{rcode: dns.RcodeFormatError, infoCode: edeOther, extraText: "expected exactly one question"}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.resolutionTimeout)
+	defer cancel()
+	state := &recursionState{
+		ctx:    ctx,
+		active: make(map[string]bool),
+	}
+	result, err := r.resolveQuestion(state, query.Question[0], 0)
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.RecursionAvailable = true
+	response.Rcode = result.Rcode
+	response.Answer = result.Answer
+	response.Ns = result.Ns
+	if opt := query.IsEdns0(); opt != nil {
+		response.SetEdns0(defaultEDNSBufferSize, opt.Do())
+	}
+
+	return response, nil
+}
+
+func (r *recursiveResolver) rootDelegation() delegation {
+	return delegation{
+		zone:    ".",
+		servers: r.rootHints,
+	}
+}
+
+// resolveQuestion follows referrals from the closest known delegation down
+// to the servers authoritative for question and returns their answer.
+func (r *recursiveResolver) resolveQuestion(state *recursionState, question dns.Question, depth int) (*dns.Msg, error) {
+	if depth > maxRecursionDepth {
+		return nil, errRecursionLimit
+	}
+
+	name := strings.ToLower(dns.Fqdn(question.Name))
+	key := name + "/" + dns.TypeToString[question.Qtype] + "/" + dns.ClassToString[question.Qclass]
+	if state.active[key] {
+		return nil, errRecursionLoop
+	}
+	state.active[key] = true
+	defer delete(state.active, key)
+
+	if cached, ok := r.answers.lookup(key); ok {
+		return cached, nil
+	}
+
+	current, ok := r.cache.closest(name)
+	if !ok {
+		current = r.rootDelegation()
+	}
+
+	// QNAME minimization (RFC 9156) reveals one more label than the zone
+	// being queried, using an A query, until the full name is reached.
+	minimize := r.qnameMinimization
+	labels := dns.CountLabel(current.zone) + 1
+	totalLabels := dns.CountLabel(name)
+
+	for referrals := 0; ; {
+		queryName, queryType := name, question.Qtype
+		minimized := minimize && labels < totalLabels
+		if minimized {
+			queryName, queryType = lastLabels(name, labels), dns.TypeA
+		}
+
+		response, err := r.queryServers(state, current.servers, queryName, queryType, question.Qclass)
+		if err != nil {
+			if minimized && err != errRecursionLimit && err != errRecursionTime {
+				// Some servers reject minimized queries outright, with
+				// NOTIMP for instance, so retry with the full name.
+				minimize = false
+				continue
+			}
+			return nil, err
+		}
+
+		if zone, nameServers, ttl, ok := findReferral(response, current.zone, queryName); ok {
+			referrals++
+			if referrals > maxReferrals {
+				return nil, errRecursionLimit
+			}
+
+			servers, err := r.delegationServers(state, current.zone, nameServers, response, depth)
+			if err != nil {
+				return nil, err
+			}
+			current = delegation{
+				zone:    zone,
+				servers: servers,
+				expires: time.Now().Add(time.Duration(ttl) * time.Second),
+			}
+			r.cache.store(current)
+			labels = dns.CountLabel(zone) + 1
+			continue
+		}
+
+		if minimized {
+			if response.Rcode == dns.RcodeSuccess {
+				// No zone cut at this label, reveal the next one.
+				labels++
+			} else {
+				// Some servers answer minimized queries incorrectly, so ask
+				// for the full name before trusting a negative answer.
+				minimize = false
+			}
+			continue
+		}
+
+		response, err = r.followCNAME(state, question, current.zone, response, depth)
+		if err != nil {
+			return nil, err
+		}
+		r.answers.store(key, response)
+		return response, nil
+	}
+}
+
+// findReferral reports whether response delegates queryName to a zone below
+// zone, returning the child zone, its name servers and the delegation TTL.
+func findReferral(response *dns.Msg, zone string, queryName string) (string, []string, uint32, bool) {
+	if response.Rcode != dns.RcodeSuccess || response.Authoritative || len(response.Answer) > 0 {
+		return "", nil, 0, false
+	}
+
+	childZone := ""
+	var nameServers []string
+	ttl := uint32(0)
+	for _, rr := range response.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(ns.Hdr.Name)
+		// Referrals must move strictly closer to the queried name, which
+		// rules out both out-of-bailiwick data and referral loops.
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, queryName) {
+			continue
+		}
+		if childZone == "" {
+			childZone = owner
+			ttl = ns.Hdr.Ttl
+		} else if owner != childZone {
+			continue
+		}
+		if ns.Hdr.Ttl < ttl {
+			ttl = ns.Hdr.Ttl
+		}
+		nameServers = append(nameServers, strings.ToLower(ns.Ns))
+	}
+
+	return childZone, nameServers, ttl, childZone != ""
+}
+
+// delegationServers returns the addresses of nameServers, using glue from
+// the referral when it is within zone and resolving them otherwise.
+func (r *recursiveResolver) delegationServers(state *recursionState, zone string, nameServers []string, referral *dns.Msg, depth int) ([]string, error) {
+	var servers []string
+	for _, nameServer := range nameServers {
+		if !dns.IsSubDomain(zone, nameServer) {
+			continue
+		}
+		for _, rr := range referral.Extra {
+			if !strings.EqualFold(rr.Header().Name, nameServer) {
+				continue
+			}
+			switch glue := rr.(type) {
+			case *dns.A:
+				servers = append(servers, net.JoinHostPort(glue.A.String(), r.port))
+			case *dns.AAAA:
+				servers = append(servers, net.JoinHostPort(glue.AAAA.String(), r.port))
+			}
+		}
+	}
+	if len(servers) > 0 {
+		return servers, nil
+	}
+
+	var lastErr error
+	for _, nameServer := range nameServers {
+		addressResponse, err := r.resolveQuestion(state, dns.Question{Name: nameServer, Qtype: dns.TypeA, Qclass: dns.ClassINET}, depth+1)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range addressResponse.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				servers = append(servers, net.JoinHostPort(a.A.String(), r.port))
+			}
+		}
+		if len(servers) > 0 {
+			return servers, nil
+		}
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, &extendedDNSError{rcode: dns.RcodeServerFailure, infoCode: edeNoReachableAuthority, extraText: "no addresses for " + zone + " name servers"}
+}
+
+// queryServers sends a non-recursive query to each of servers in turn and
+// returns the first usable answer.
+func (r *recursiveResolver) queryServers(state *recursionState, servers []string, name string, qtype uint16, qclass uint16) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+	query.Question[0].Qclass = qclass
+	query.RecursionDesired = false
+	query.SetEdns0(defaultEDNSBufferSize, false)
+
+	var lastErr error
+	for _, server := range servers {
+		state.queries++
+		if state.queries > maxQueriesPerResolution {
+			return nil, errRecursionLimit
+		}
+		timeout := r.timeout
+		if deadline, ok := state.ctx.Deadline(); ok && time.Until(deadline) < timeout {
+			timeout = time.Until(deadline)
+		}
+		if state.ctx.Err() != nil || timeout <= 0 {
+			return nil, errRecursionTime
+		}
+
+		client := &dns.Client{Net: "udp", Timeout: timeout}
+		response, _, err := client.ExchangeContext(state.ctx, query, server)
+		if err == nil && response.Truncated {
+			client.Net = "tcp"
+			response, _, err = client.ExchangeContext(state.ctx, query, server)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if response.Rcode == dns.RcodeServerFailure || response.Rcode == dns.RcodeRefused || response.Rcode == dns.RcodeNotImplemented {
+			lastErr = fmt.Errorf("%s answered %s", server, dns.RcodeToString[response.Rcode])
+			continue
+		}
+		return response, nil
+	}
+
+	return nil, &extendedDNSError{rcode: dns.RcodeServerFailure, infoCode: edeNoReachableAuthority, extraText: "no reachable authority for " + name, err: lastErr}
+}
+
+// followCNAME completes response to question by resolving the target of a
+// CNAME chain that leaves zone. Records outside zone are not trusted.
+func (r *recursiveResolver) followCNAME(state *recursionState, question dns.Question, zone string, response *dns.Msg, depth int) (*dns.Msg, error) {
+	var answers []dns.RR
+	for _, rr := range response.Answer {
+		if dns.IsSubDomain(zone, strings.ToLower(rr.Header().Name)) {
+			answers = append(answers, rr)
+		}
+	}
+	response.Answer = answers
+
+	if question.Qtype == dns.TypeCNAME || response.Rcode != dns.RcodeSuccess {
+		return response, nil
+	}
+
+	name := question.Name
+	seen := make(map[string]bool)
+	for {
+		if seen[strings.ToLower(name)] {
+			return nil, errRecursionLoop
+		}
+		seen[strings.ToLower(name)] = true
+
+		target := ""
+		for _, rr := range response.Answer {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if rr.Header().Rrtype == question.Qtype {
+				return response, nil
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				target = cname.Target
+			}
+		}
+		if target == "" {
+			return response, nil
+		}
+
+		name = target
+		if hasOwner(response.Answer, target) {
+			continue
+		}
+
+		targetResponse, err := r.resolveQuestion(state, dns.Question{Name: target, Qtype: question.Qtype, Qclass: question.Qclass}, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		response.Answer = append(response.Answer, targetResponse.Answer...)
+		response.Ns = targetResponse.Ns
+		response.Rcode = targetResponse.Rcode
+		return response, nil
+	}
+}
+
+func hasOwner(records []dns.RR, name string) bool {
+	for _, rr := range records {
+		if strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,396 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubZone answers for zone like an authoritative server: with a referral
+// for names under one of delegations, from records otherwise.
+type stubZone struct {
+	zone        string
+	delegations map[string]string
+	records     []string
+	queries     int32
+}
+
+func (z *stubZone) ServeDNS(w dns.ResponseWriter, query *dns.Msg) {
+	atomic.AddInt32(&z.queries, 1)
+	response := new(dns.Msg)
+	response.SetReply(query)
+	name := strings.ToLower(query.Question[0].Name)
+
+	for child, address := range z.delegations {
+		if dns.IsSubDomain(child, name) {
+			nameServer := "ns." + child
+			response.Ns = append(response.Ns, mustRR("%s 3600 IN NS %s", child, nameServer))
+			response.Extra = append(response.Extra, mustRR("%s 3600 IN A %s", nameServer, address))
+			w.WriteMsg(response)
+			return
+		}
+	}
+
+	response.Authoritative = true
+	exists := false
+	for _, record := range z.records {
+		rr := mustRR(record)
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		exists = true
+		if rr.Header().Rrtype == query.Question[0].Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+			response.Answer = append(response.Answer, rr)
+		}
+	}
+	if !exists {
+		response.Rcode = dns.RcodeNameError
+	}
+	if len(response.Answer) == 0 {
+		response.Ns = append(response.Ns, mustRR("%s 3600 IN SOA ns.%s hostmaster.%s 1 3600 600 86400 300", z.zone, z.zone, z.zone))
+	}
+	w.WriteMsg(response)
+}
+
+func mustRR(format string, args ...interface{}) dns.RR {
+	rr, err := dns.NewRR(fmt.Sprintf(format, args...))
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+// startStubServer serves handler over UDP on address and returns a function
+// stopping it.
+func startStubServer(t *testing.T, address string, handler dns.Handler) func() {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", address, err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	return func() { server.Shutdown() }
+}
+
+// referringZone answers every query with a referral to the zone returned by
+// child, whose name server is at address.
+type referringZone struct {
+	child   func(name string) string
+	address string
+	queries int32
+}
+
+func (z *referringZone) ServeDNS(w dns.ResponseWriter, query *dns.Msg) {
+	atomic.AddInt32(&z.queries, 1)
+	response := new(dns.Msg)
+	response.SetReply(query)
+	child := z.child(strings.ToLower(query.Question[0].Name))
+	nameServer := "ns." + child
+	response.Ns = append(response.Ns, mustRR("%s 3600 IN NS %s", child, nameServer))
+	response.Extra = append(response.Extra, mustRR("%s 3600 IN A %s", nameServer, z.address))
+	w.WriteMsg(response)
+}
+
+// pickyZone answers the A query for name and fails every other query with
+// rcode, like servers that do not cope with QNAME minimization.
+type pickyZone struct {
+	name    string
+	rcode   int
+	answers int32
+}
+
+func (z *pickyZone) ServeDNS(w dns.ResponseWriter, query *dns.Msg) {
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Authoritative = true
+	if strings.EqualFold(query.Question[0].Name, z.name) && query.Question[0].Qtype == dns.TypeA {
+		atomic.AddInt32(&z.answers, 1)
+		response.Answer = append(response.Answer, mustRR("%s 300 IN A 192.0.2.7", z.name))
+	} else {
+		response.Rcode = z.rcode
+	}
+	w.WriteMsg(response)
+}
+
+// stubHierarchy is a root, a TLD and a leaf zone served on loopback
+// addresses, with a delegation to a server that never answers. The TLD also
+// delegates to deep.example., picky.example. and upward.example., which
+// tests serve themselves.
+type stubHierarchy struct {
+	port string
+	root *stubZone
+	tld  *stubZone
+	leaf *stubZone
+	stop []func()
+}
+
+func newStubHierarchy(t *testing.T) *stubHierarchy {
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(probe.LocalAddr().String())
+	probe.Close()
+
+	h := &stubHierarchy{
+		port: port,
+		root: &stubZone{zone: ".", delegations: map[string]string{"example.": "127.0.0.2"}},
+		tld: &stubZone{zone: "example.", delegations: map[string]string{
+			"test.example.":   "127.0.0.3",
+			"slow.example.":   "127.0.0.4",
+			"deep.example.":   "127.0.0.5",
+			"picky.example.":  "127.0.0.6",
+			"upward.example.": "127.0.0.7",
+		}},
+		leaf: &stubZone{zone: "test.example.", records: []string{
+			"www.test.example. 300 IN A 192.0.2.1",
+			"alias.test.example. 300 IN CNAME www.test.example.",
+			"empty.test.example. 300 IN TXT \"no address\"",
+		}},
+	}
+	h.stop = append(h.stop,
+		startStubServer(t, net.JoinHostPort("127.0.0.1", port), h.root),
+		startStubServer(t, net.JoinHostPort("127.0.0.2", port), h.tld),
+		startStubServer(t, net.JoinHostPort("127.0.0.3", port), h.leaf))
+
+	silent, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.4", port))
+	if err != nil {
+		h.close()
+		t.Skipf("cannot listen on 127.0.0.4: %v", err)
+	}
+	h.stop = append(h.stop, func() { silent.Close() })
+	return h
+}
+
+func (h *stubHierarchy) close() {
+	for _, stop := range h.stop {
+		stop()
+	}
+}
+
+func (h *stubHierarchy) queries() int32 {
+	return atomic.LoadInt32(&h.root.queries) + atomic.LoadInt32(&h.tld.queries) + atomic.LoadInt32(&h.leaf.queries)
+}
+
+func TestRecursiveResolver(t *testing.T) {
+	h := newStubHierarchy(t)
+	defer h.close()
+	resolver := newRecursiveResolver([]string{"127.0.0.1"}, h.port, time.Second, 5*time.Second)
+
+	for _, test := range []struct {
+		name    string
+		rcode   int
+		answers []string
+	}{
+		{name: "www.test.example.", rcode: dns.RcodeSuccess, answers: []string{"192.0.2.1"}},
+		{name: "alias.test.example.", rcode: dns.RcodeSuccess, answers: []string{"www.test.example.", "192.0.2.1"}},
+		{name: "empty.test.example.", rcode: dns.RcodeSuccess},
+		{name: "missing.test.example.", rcode: dns.RcodeNameError},
+	} {
+		query := new(dns.Msg)
+		query.SetQuestion(test.name, dns.TypeA)
+		response, err := resolver.resolve(context.Background(), query)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if response.Rcode != test.rcode {
+			t.Errorf("%s: rcode %s, want %s", test.name, dns.RcodeToString[response.Rcode], dns.RcodeToString[test.rcode])
+		}
+		var answers []string
+		for _, rr := range response.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				answers = append(answers, rr.A.String())
+			case *dns.CNAME:
+				answers = append(answers, rr.Target)
+			}
+		}
+		if strings.Join(answers, " ") != strings.Join(test.answers, " ") {
+			t.Errorf("%s: answers %v, want %v", test.name, answers, test.answers)
+		}
+	}
+}
+
+func TestRecursiveResolverCachesAnswers(t *testing.T) {
+	h := newStubHierarchy(t)
+	defer h.close()
+	resolver := newRecursiveResolver([]string{"127.0.0.1"}, h.port, time.Second, 5*time.Second)
+
+	for _, name := range []string{"www.test.example.", "missing.test.example."} {
+		query := new(dns.Msg)
+		query.SetQuestion(name, dns.TypeA)
+		if _, err := resolver.resolve(context.Background(), query); err != nil {
+			t.Fatal(err)
+		}
+		queries := h.queries()
+		response, err := resolver.resolve(context.Background(), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sent := h.queries() - queries; sent != 0 {
+			t.Errorf("%s: %d queries sent for a cached answer", name, sent)
+		}
+		if response.Id != query.Id {
+			t.Errorf("%s: cached answer has ID %d, want %d", name, response.Id, query.Id)
+		}
+	}
+}
+
+func TestRecursiveResolverTimeout(t *testing.T) {
+	h := newStubHierarchy(t)
+	defer h.close()
+	resolver := newRecursiveResolver([]string{"127.0.0.1"}, h.port, time.Second, 300*time.Millisecond)
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.slow.example.", dns.TypeA)
+	start := time.Now()
+	if _, err := resolver.resolve(context.Background(), query); err == nil {
+		t.Fatal("resolution through a silent server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("resolution took %v, longer than its budget", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	query.SetQuestion("www.test.example.", dns.TypeA)
+	if _, err := resolver.resolve(ctx, query); err != errRecursionTime {
+		t.Errorf("resolution with a canceled context: %v, want %v", err, errRecursionTime)
+	}
+}
+
+func TestRecursiveResolverLimits(t *testing.T) {
+	h := newStubHierarchy(t)
+	defer h.close()
+	var chain []string
+	for index := 0; index <= maxRecursionDepth+1; index++ {
+		chain = append(chain, fmt.Sprintf("chain%d.test.example. 300 IN CNAME chain%d.test.example.", index, index+1))
+	}
+	h.leaf.records = append(h.leaf.records,
+		"loop1.test.example. 300 IN CNAME loop2.test.example.",
+		"loop2.test.example. 300 IN CNAME loop1.test.example.")
+	h.leaf.records = append(h.leaf.records, chain...)
+	deep := &referringZone{child: func(name string) string { return name }, address: "127.0.0.5"}
+	defer startStubServer(t, net.JoinHostPort("127.0.0.5", h.port), deep)()
+
+	for _, test := range []struct {
+		name string
+		err  error
+	}{
+		{name: "loop1.test.example.", err: errRecursionLoop},
+		{name: "chain0.test.example.", err: errRecursionLimit},
+		{name: strings.Repeat("a.", maxReferrals+2) + "deep.example.", err: errRecursionLimit},
+	} {
+		resolver := newRecursiveResolver([]string{"127.0.0.1"}, h.port, time.Second, 5*time.Second)
+		query := new(dns.Msg)
+		query.SetQuestion(test.name, dns.TypeA)
+		if _, err := resolver.resolve(context.Background(), query); err != test.err {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+		}
+	}
+	if referrals := atomic.LoadInt32(&deep.queries); referrals > maxReferrals {
+		t.Errorf("%d referrals followed, want at most %d", referrals, maxReferrals)
+	}
+}
+
+func TestRecursiveResolverQueryLimit(t *testing.T) {
+	h := newStubHierarchy(t)
+	defer h.close()
+	var refused int32
+	defer startStubServer(t, net.JoinHostPort("127.0.0.8", h.port), dns.HandlerFunc(func(w dns.ResponseWriter, query *dns.Msg) {
+		atomic.AddInt32(&refused, 1)
+		response := new(dns.Msg)
+		response.SetRcode(query, dns.RcodeRefused)
+		w.WriteMsg(response)
+	}))()
+
+	rootHints := make([]string, maxQueriesPerResolution+8)
+	for index := range rootHints {
+		rootHints[index] = "127.0.0.8"
+	}
+	resolver := newRecursiveResolver(rootHints, h.port, time.Second, 5*time.Second)
+	query := new(dns.Msg)
+	query.SetQuestion("www.test.example.", dns.TypeA)
+	if _, err := resolver.resolve(context.Background(), query); err != errRecursionLimit {
+		t.Errorf("resolution through refusing servers: %v, want %v", err, errRecursionLimit)
+	}
+	if queries := atomic.LoadInt32(&refused); queries > maxQueriesPerResolution {
+		t.Errorf("%d queries sent, want at most %d", queries, maxQueriesPerResolution)
+	}
+}
+
+func TestRecursiveResolverIgnoresUpwardReferrals(t *testing.T) {
+	h := newStubHierarchy(t)
+	defer h.close()
+	upward := &referringZone{child: func(string) string { return "example." }, address: "127.0.0.2"}
+	defer startStubServer(t, net.JoinHostPort("127.0.0.7", h.port), upward)()
+	resolver := newRecursiveResolver([]string{"127.0.0.1"}, h.port, time.Second, 5*time.Second)
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.upward.example.", dns.TypeA)
+	response, err := resolver.resolve(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Answer) != 0 {
+		t.Errorf("answers %v, want none", response.Answer)
+	}
+	if queries := atomic.LoadInt32(&upward.queries); queries != 1 {
+		t.Errorf("%d queries sent to the zone referring upwards, want 1", queries)
+	}
+}
+
+func TestRecursiveResolverMinimizationFallback(t *testing.T) {
+	for _, rcode := range []int{dns.RcodeNameError, dns.RcodeNotImplemented} {
+		t.Run(dns.RcodeToString[rcode], func(t *testing.T) {
+			h := newStubHierarchy(t)
+			defer h.close()
+			picky := &pickyZone{name: "www.sub.picky.example.", rcode: rcode}
+			defer startStubServer(t, net.JoinHostPort("127.0.0.6", h.port), picky)()
+			resolver := newRecursiveResolver([]string{"127.0.0.1"}, h.port, time.Second, 5*time.Second)
+
+			query := new(dns.Msg)
+			query.SetQuestion(picky.name, dns.TypeA)
+			response, err := resolver.resolve(context.Background(), query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 {
+				t.Errorf("rcode %s and answers %v, want the address of %s", dns.RcodeToString[response.Rcode], response.Answer, picky.name)
+			}
+			if answers := atomic.LoadInt32(&picky.answers); answers != 1 {
+				t.Errorf("%d queries for the full name, want 1", answers)
+			}
+		})
+	}
+}
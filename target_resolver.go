@@ -23,12 +23,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/miekg/dns"
 	"net"
 	"time"
 )
 
+// queryResolver answers DNS queries on behalf of the target.
+type queryResolver interface {
+	resolve(ctx context.Context, query *dns.Msg) (*dns.Msg, error)
+	getResolverServerName() string
+}
+
 type targetResolver struct {
 	nameserver string
 	timeout    time.Duration
@@ -38,15 +45,22 @@ func (s targetResolver) getResolverServerName() string {
 	return s.nameserver
 }
 
-func (s targetResolver) resolve(query *dns.Msg) (*dns.Msg, error) {
+func (s targetResolver) resolve(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	deadline := time.Now().Add(s.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
 	connection := new(dns.Conn)
 	var err error
-	if connection.Conn, err = net.DialTimeout("tcp", s.nameserver, s.timeout*time.Millisecond); err != nil {
-		return nil, fmt.Errorf("Failed starting resolver connection")
+	dialer := &net.Dialer{Deadline: deadline}
+	if connection.Conn, err = dialer.DialContext(ctx, "tcp", s.nameserver); err != nil {
+		return nil, fmt.Errorf("Failed starting resolver connection: %w", err)
 	}
+	defer connection.Close()
 
-	connection.SetReadDeadline(time.Now().Add(s.timeout * time.Millisecond))
-	connection.SetWriteDeadline(time.Now().Add(s.timeout * time.Millisecond))
+	connection.SetReadDeadline(deadline)
+	connection.SetWriteDeadline(deadline)
 
 	if err := connection.WriteMsg(query); err != nil {
 		return nil, err
@@ -0,0 +1,81 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"github.com/chris-wood/odoh"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestObliviousQueryHandlerMalformedQuery(t *testing.T) {
+	keyPair, err := odoh.CreateKeyPairFromSeed(kemID, kdfID, aeadID, make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &stubUpstream{validated: stubAnswer(dns.RcodeSuccess)}
+	s := &targetServer{
+		resolver:        []queryResolver{upstream},
+		odohKeyPair:     keyPair,
+		telemetryClient: &telemetry{},
+	}
+
+	// A header announcing a question whose name is truncated
+	malformed := []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 'a'}
+	if _, err := decodeDNSQuestion(malformed); err == nil {
+		t.Fatal("malformed query decoded")
+	}
+	sealed, queryContext, err := odoh.SealQuery(malformed, keyPair.Config.Contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(sealed.Marshal()))
+	r.Header.Set("Content-Type", obliviousDNSMessageContentType)
+	w := httptest.NewRecorder()
+	s.obliviousQueryHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	message, err := odoh.UnmarshalDNSMessage(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := queryContext.OpenAnswer(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := new(dns.Msg)
+	if err := response.Unpack(answer); err != nil {
+		t.Fatal(err)
+	}
+	if response.Rcode != dns.RcodeFormatError || response.Id != 0x1234 || !response.Response {
+		t.Errorf("answer %v, want a FORMERR response with ID 0x1234", response)
+	}
+	if upstream.queries != 0 {
+		t.Errorf("%d queries sent upstream for a malformed query", upstream.queries)
+	}
+}
@@ -48,6 +48,7 @@ type telemetry struct {
 	buffer      []string
 	logClient   *logging.Client
 	cloudlogger *logging.Logger
+	index       string
 }
 
 const (
@@ -57,13 +58,11 @@ const (
 
 var telemetryInstance telemetry
 
-func getTelemetryInstance(telemetryType string) *telemetry {
+func getTelemetryInstance(config telemetryConfig) *telemetry {
 	var err error
-	if telemetryType == "ELK" {
+	if config.Type == "ELK" {
 		elasticsearchTransport := elasticsearch.Config{
-			Addresses: []string{
-				"http://localhost:9200",
-			},
+			Addresses: config.ElasticsearchAddresses,
 			Transport: &http.Transport{
 				MaxIdleConnsPerHost: 1024,
 			},
@@ -72,15 +71,14 @@ func getTelemetryInstance(telemetryType string) *telemetry {
 		if err != nil {
 			log.Fatalf("Unable to create an elasticsearch client connection.")
 		}
-	} else if telemetryType == "GCP" {
+		telemetryInstance.index = config.ElasticsearchIndex
+	} else if config.Type == "GCP" {
 		ctx := context.Background()
-		projectID := "odoh-target"
-		telemetryInstance.logClient, err = logging.NewClient(ctx, projectID)
+		telemetryInstance.logClient, err = logging.NewClient(ctx, config.GCPProjectID)
 		if err != nil {
 			log.Fatalf("Unable to create a logging instance to Google Cloud %v", err)
 		}
-		logName := "odohserver-gcp"
-		telemetryInstance.cloudlogger = telemetryInstance.logClient.Logger(logName)
+		telemetryInstance.cloudlogger = telemetryInstance.logClient.Logger(config.GCPLogName)
 	} else {
 		telemetryInstance.cloudlogger = nil
 		telemetryInstance.esClient = nil
@@ -103,7 +101,7 @@ func (t *telemetry) streamDataToElastic(dataItems []string) {
 		go func(i int, message string) {
 			defer wg.Done()
 			req := esapi.IndexRequest{
-				Index:   INDEX,
+				Index:   t.index,
 				Body:    strings.NewReader(message),
 				Refresh: "true",
 			}
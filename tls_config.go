@@ -0,0 +1,246 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cipher suites of the listener for TLS 1.2, all forward secret AEADs.
+// TLS 1.3 suites are not configurable and all modern.
+var serverCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+var (
+	errNoClientCertificate = errors.New("no verified client certificate")
+	errProxyNotAllowed     = errors.New("client certificate identity is not an allowed proxy")
+)
+
+// loadCertPool reads the PEM encoded certificates in path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// certificateReloader serves the certificate in certFile and keyFile and
+// reloads it when either file changes, so that renewed certificates are
+// picked up without a restart. A pair that fails to load, for instance
+// because only one of the files was replaced yet, is retried on the next
+// check while the previous certificate keeps being served.
+type certificateReloader struct {
+	sync.RWMutex
+	certFile    string
+	keyFile     string
+	certificate *tls.Certificate
+	versions    [2]fileVersion
+	metrics     *metrics
+}
+
+// fileVersion identifies the contents of a file by its size and time of
+// last modification.
+type fileVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+func statFileVersion(path string) (fileVersion, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func newCertificateReloader(certFile string, keyFile string, metrics *metrics) (*certificateReloader, error) {
+	reloader := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		metrics:  metrics,
+	}
+	if _, err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// reload loads the certificate if its files changed since the last load
+// and reports whether it did.
+func (c *certificateReloader) reload() (bool, error) {
+	var versions [2]fileVersion
+	for index, path := range []string{c.certFile, c.keyFile} {
+		version, err := statFileVersion(path)
+		if err != nil {
+			return false, err
+		}
+		versions[index] = version
+	}
+	c.RLock()
+	unchanged := c.certificate != nil && versions == c.versions
+	c.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.Lock()
+	c.certificate = &certificate
+	c.versions = versions
+	c.Unlock()
+	return true, nil
+}
+
+// watch checks the certificate files for changes every interval.
+func (c *certificateReloader) watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			reloaded, err := c.reload()
+			if err != nil {
+				log.Printf("Failed reloading TLS certificate %s: %v", c.certFile, err)
+				c.metrics.increment("tls_certificate_reload_error")
+			} else if reloaded {
+				log.Printf("Reloaded TLS certificate %s", c.certFile)
+				c.metrics.increment("tls_certificate_reloaded")
+			}
+		}
+	}()
+}
+
+// GetCertificate returns the current certificate, for tls.Config.
+func (c *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.certificate, nil
+}
+
+// newServerTLSConfig returns the TLS configuration of the listener, serving
+// the certificates of reloader with HTTP/2 and modern cipher suites. Client
+// certificates are verified against clientCAFile when it is set, but only
+// required by the handlers that need them, so that health checks and the
+// proxy endpoint keep working without one.
+func newServerTLSConfig(reloader *certificateReloader, clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate:           reloader.GetCertificate,
+		MinVersion:               tls.VersionTLS12,
+		CipherSuites:             serverCipherSuites,
+		CurvePreferences:         []tls.CurveID{tls.X25519, tls.CurveP256},
+		PreferServerCipherSuites: true,
+		NextProtos:               []string{"h2", "http/1.1"},
+	}
+	if clientCAFile != "" {
+		var err error
+		config.ClientCAs, err = loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// newProxyTLSConfig returns the TLS configuration the proxy uses towards
+// targets: an optional client certificate and optional extra roots.
+func newProxyTLSConfig(certFile string, keyFile string, targetCAFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	if targetCAFile != "" {
+		var err error
+		config.RootCAs, err = loadCertPool(targetCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// proxyAuthenticator restricts the target to proxies presenting a verified
+// client certificate, optionally with one of a set of identities.
+type proxyAuthenticator struct {
+	allowed map[string]bool
+}
+
+func newProxyAuthenticator(identities []string) *proxyAuthenticator {
+	allowed := make(map[string]bool)
+	for _, identity := range identities {
+		allowed[strings.ToLower(identity)] = true
+	}
+	return &proxyAuthenticator{allowed: allowed}
+}
+
+// certificateIdentities returns the DNS and URI names of certificate.
+func certificateIdentities(certificate *x509.Certificate) []string {
+	identities := append([]string(nil), certificate.DNSNames...)
+	for _, uri := range certificate.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
+
+// checkRequest returns an error unless r comes from an allowed proxy.
+func (a *proxyAuthenticator) checkRequest(r *http.Request) error {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return errNoClientCertificate
+	}
+	if len(a.allowed) == 0 {
+		return nil
+	}
+	for _, identity := range certificateIdentities(r.TLS.VerifiedChains[0][0]) {
+		if a.allowed[strings.ToLower(identity)] {
+			return nil
+		}
+	}
+	return errProxyNotAllowed
+}
@@ -0,0 +1,280 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+)
+
+// This file implements both sides of blind RSA issuance (RFC 9474,
+// RSABSSA-SHA384-PSS-Deterministic) for the issue-tokens command, which
+// mints tokens the proxy accepts for local testing. A production issuer
+// runs separately and only shares its public key with the proxy.
+
+const tokenIssuerKeyBits = 2048
+
+var (
+	errBlindSignature = errors.New("blind signature verification failed")
+	errBlindingFactor = errors.New("blinding factor not invertible")
+)
+
+// mgf1XOR masks out with MGF1 keyed by seed, using SHA-384.
+func mgf1XOR(out []byte, seed []byte) {
+	var counter [4]byte
+	done := 0
+	for done < len(out) {
+		digest := crypto.SHA384.New()
+		digest.Write(seed)
+		digest.Write(counter[:])
+		for _, b := range digest.Sum(nil) {
+			if done >= len(out) {
+				break
+			}
+			out[done] ^= b
+			done++
+		}
+		for i := 3; i >= 0; i-- {
+			if counter[i]++; counter[i] != 0 {
+				break
+			}
+		}
+	}
+}
+
+// emsaPSSEncode encodes message with salt for a key of modulusBits bits
+// (RFC 8017, Section 9.1.1).
+func emsaPSSEncode(message []byte, modulusBits int, salt []byte) ([]byte, error) {
+	hashLength := crypto.SHA384.Size()
+	emBits := modulusBits - 1
+	emLength := (emBits + 7) / 8
+	if emLength < hashLength+len(salt)+2 {
+		return nil, errors.New("key too small for EMSA-PSS")
+	}
+
+	messageDigest := crypto.SHA384.New()
+	messageDigest.Write(message)
+
+	digest := crypto.SHA384.New()
+	digest.Write(make([]byte, 8))
+	digest.Write(messageDigest.Sum(nil))
+	digest.Write(salt)
+	h := digest.Sum(nil)
+
+	encoded := make([]byte, emLength)
+	db := encoded[:emLength-hashLength-1]
+	db[len(db)-len(salt)-1] = 0x01
+	copy(db[len(db)-len(salt):], salt)
+	mgf1XOR(db, h)
+	db[0] &= 0xff >> uint(8*emLength-emBits)
+	copy(encoded[len(db):], h)
+	encoded[emLength-1] = 0xbc
+	return encoded, nil
+}
+
+// leftPad returns value left padded with zeros to length bytes.
+func leftPad(value []byte, length int) []byte {
+	padded := make([]byte, length)
+	copy(padded[length-len(value):], value)
+	return padded
+}
+
+// blindedTokenRequest is the client state of a blind issuance.
+type blindedTokenRequest struct {
+	input   []byte
+	inverse *big.Int
+	blinded []byte
+}
+
+// blindTokenRequest blinds the input of a new token for publicKey.
+func blindTokenRequest(publicKey *rsa.PublicKey, challenge []byte, random io.Reader) (*blindedTokenRequest, error) {
+	tokenKey, err := marshalTokenKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, privateTokenNonceLength)
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return nil, err
+	}
+	challengeDigest := sha256.Sum256(challenge)
+	tokenKeyID := sha256.Sum256(tokenKey)
+	input := tokenInput(nonce, challengeDigest[:], tokenKeyID[:])
+
+	salt := make([]byte, privateTokenSaltLength)
+	if _, err := io.ReadFull(random, salt); err != nil {
+		return nil, err
+	}
+	for {
+		r, err := rand.Int(random, publicKey.N)
+		if err != nil {
+			return nil, err
+		}
+		if req, err := blindMessage(publicKey, input, salt, r); err != errBlindingFactor {
+			return req, err
+		}
+	}
+}
+
+// blindMessage encodes input with salt and blinds it with the factor r.
+func blindMessage(publicKey *rsa.PublicKey, input []byte, salt []byte, r *big.Int) (*blindedTokenRequest, error) {
+	encoded, err := emsaPSSEncode(input, publicKey.N.BitLen(), salt)
+	if err != nil {
+		return nil, err
+	}
+	m := new(big.Int).SetBytes(encoded)
+
+	if r.Sign() <= 0 {
+		return nil, errBlindingFactor
+	}
+	inverse := new(big.Int).ModInverse(r, publicKey.N)
+	if inverse == nil {
+		return nil, errBlindingFactor
+	}
+	blinded := new(big.Int).Exp(r, big.NewInt(int64(publicKey.E)), publicKey.N)
+	blinded.Mul(blinded, m).Mod(blinded, publicKey.N)
+
+	return &blindedTokenRequest{
+		input:   input,
+		inverse: inverse,
+		blinded: leftPad(blinded.Bytes(), publicKey.Size()),
+	}, nil
+}
+
+// blindSign is the issuer's side: it signs a blinded message without
+// learning the token it will authenticate.
+func blindSign(privateKey *rsa.PrivateKey, blinded []byte) ([]byte, error) {
+	m := new(big.Int).SetBytes(blinded)
+	if m.Cmp(privateKey.N) >= 0 {
+		return nil, errors.New("blinded message out of range")
+	}
+	signature := new(big.Int).Exp(m, privateKey.D, privateKey.N)
+	check := new(big.Int).Exp(signature, big.NewInt(int64(privateKey.E)), privateKey.N)
+	if check.Cmp(m) != 0 {
+		return nil, errBlindSignature
+	}
+	return leftPad(signature.Bytes(), privateKey.Size()), nil
+}
+
+// finalize unblinds the issuer's signature into a token.
+func (req *blindedTokenRequest) finalize(publicKey *rsa.PublicKey, blindSignature []byte) ([]byte, error) {
+	signature := new(big.Int).SetBytes(blindSignature)
+	signature.Mul(signature, req.inverse).Mod(signature, publicKey.N)
+	authenticator := leftPad(signature.Bytes(), publicKey.Size())
+
+	digest := crypto.SHA384.New()
+	digest.Write(req.input)
+	options := &rsa.PSSOptions{SaltLength: privateTokenSaltLength, Hash: crypto.SHA384}
+	if err := rsa.VerifyPSS(publicKey, crypto.SHA384, digest.Sum(nil), authenticator, options); err != nil {
+		return nil, errBlindSignature
+	}
+	return append(append([]byte(nil), req.input...), authenticator...), nil
+}
+
+// loadOrCreateIssuerKey reads the issuer private key at path, generating
+// and saving a new one if the file does not exist.
+func loadOrCreateIssuerKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		privateKey, err := rsa.GenerateKey(rand.Reader, tokenIssuerKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		encoded := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+		if err := ioutil.WriteFile(path, encoded, 0600); err != nil {
+			return nil, err
+		}
+		return privateKey, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: not a PEM encoded RSA private key", path)
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// runTokenIssuer implements the issue-tokens command. It acts as both client
+// and issuer and prints one Authorization header value per token.
+func runTokenIssuer(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("issue-tokens", flag.ContinueOnError)
+	keyPath := flags.String("key", "token-issuer.pem", "issuer private key, generated if missing")
+	publicKeyPath := flags.String("public-key", "", "also write the issuer public key to this file, for proxy.tokens.issuer_key_file")
+	issuerName := flags.String("issuer-name", "", "issuer name, as in proxy.tokens.issuer_name")
+	originInfo := flags.String("origin-info", "", "origin info, as in proxy.tokens.origin_info")
+	count := flags.Int("count", 1, "number of tokens to issue")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *issuerName == "" {
+		return errors.New("--issuer-name is required")
+	}
+
+	privateKey, err := loadOrCreateIssuerKey(*keyPath)
+	if err != nil {
+		return err
+	}
+	if *publicKeyPath != "" {
+		publicKey, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+		if err != nil {
+			return err
+		}
+		encoded := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})
+		if err := ioutil.WriteFile(*publicKeyPath, encoded, 0644); err != nil {
+			return err
+		}
+	}
+
+	challenge := createTokenChallenge(*issuerName, *originInfo)
+	for i := 0; i < *count; i++ {
+		req, err := blindTokenRequest(&privateKey.PublicKey, challenge, rand.Reader)
+		if err != nil {
+			return err
+		}
+		blindSignature, err := blindSign(privateKey, req.blinded)
+		if err != nil {
+			return err
+		}
+		token, err := req.finalize(&privateKey.PublicKey, blindSignature)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(out, "%s token=\"%s\"\n", privateTokenScheme, base64.RawURLEncoding.EncodeToString(token)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
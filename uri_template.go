@@ -0,0 +1,118 @@
+// The MIT License
+//
+// Copyright (c) 2019 Apple, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// expandURITemplate expands the variables of an RFC 6570 URI template. Only
+// the expressions needed for ODoH templates are supported: simple string
+// expansion, such as "{targethost}", and form-style query expansion and
+// continuation, such as "{?targethost,targetpath}" and "{&dns}". Undefined
+// variables are omitted.
+func expandURITemplate(template string, variables map[string]string) (string, error) {
+	var expanded strings.Builder
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			if strings.IndexByte(template, '}') >= 0 {
+				return "", fmt.Errorf("unbalanced '}' in URI template")
+			}
+			expanded.WriteString(template)
+			return expanded.String(), nil
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated expression in URI template")
+		}
+		expanded.WriteString(template[:start])
+		expression := template[start+1 : start+end]
+		template = template[start+end+1:]
+
+		operator := ""
+		if expression != "" && strings.ContainsRune("?&", rune(expression[0])) {
+			operator, expression = expression[:1], expression[1:]
+		}
+		first := true
+		for _, name := range strings.Split(expression, ",") {
+			if name == "" || strings.ContainsAny(name, "+#./;=:*{") {
+				return "", fmt.Errorf("unsupported URI template variable %q", name)
+			}
+			value, ok := variables[name]
+			if !ok {
+				continue
+			}
+			switch {
+			case operator == "":
+				if !first {
+					expanded.WriteByte(',')
+				}
+			case first:
+				expanded.WriteString(operator)
+				expanded.WriteString(name + "=")
+			default:
+				expanded.WriteString("&" + name + "=")
+			}
+			expanded.WriteString(escapeURITemplateValue(value))
+			first = false
+		}
+	}
+}
+
+// uriTemplateVariables returns the names of the variables used by template.
+func uriTemplateVariables(template string) []string {
+	var names []string
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			return names
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return names
+		}
+		expression := strings.TrimLeft(template[start+1:start+end], "?&")
+		names = append(names, strings.Split(expression, ",")...)
+		template = template[start+end+1:]
+	}
+}
+
+// escapeURITemplateValue percent-encodes every character of value other
+// than the unreserved ones, as RFC 6570 requires for these expressions.
+func escapeURITemplateValue(value string) string {
+	const hex = "0123456789ABCDEF"
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.IndexByte("-._~", c) >= 0 {
+			escaped.WriteByte(c)
+		} else {
+			escaped.WriteByte('%')
+			escaped.WriteByte(hex[c>>4])
+			escaped.WriteByte(hex[c&15])
+		}
+	}
+	return escaped.String()
+}